@@ -3,13 +3,20 @@ package main
 import (
 	"bufio"
 	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
 )
 
@@ -19,58 +26,434 @@ const (
 	STOCK_FILE                 string  = "/Users/albert/Desktop/stocks/stocks.txt"
 	OUTPUT_FILE                string  = "/Users/albert/Desktop/stocks/output/%s_output.txt"
 	OUTPUT_SYMBOLS_FILE        string  = "/Users/albert/Desktop/stocks/output/%s_symbols.txt"
+	OUTPUT_JSON_FILE           string  = "/Users/albert/Desktop/stocks/output/%s_output.jsonl"
+	OUTPUT_CSV_FILE            string  = "/Users/albert/Desktop/stocks/output/%s_output.csv"
+	OUTPUT_CHART_FILE          string  = "/Users/albert/Desktop/stocks/output/%s_%s_chart.svg"
 	NUM_YEARS_DATA             int     = 1
 	START_PIVOT_WIDTH          int     = 3
 	PIVOT_WIDTH                int     = 5
 	SUPPORT_PIVOT_WIDTH        int     = 20
+	PROVISIONAL_MIN_BARS       int     = 2
+	WINDOW_DETECTOR            string  = "window"
+	ZIGZAG_DETECTOR            string  = "zigzag"
+	PERCENT_DETECTOR           string  = "percent"
+	FRACTAL_DETECTOR           string  = "fractal"
+	TIES_ALL                   string  = "all"
+	TIES_FIRST                 string  = "first"
+	TIES_LAST                  string  = "last"
+	ZIGZAG_ATR_MULTIPLE        float64 = 2.0
+	PERCENT_REVERSAL           float64 = 0.05
+	FRACTAL_WIDTH              int     = 2
+	STRICT_FIT                 string  = "strict"
+	TOLERANCE_FIT              string  = "tolerance"
+	ATR_TOLERANCE              string  = "atr"
+	PERCENT_TOLERANCE          string  = "percent"
+	LINE_TOLERANCE_ATR         float64 = 0.25
+	LINE_TOLERANCE_PERCENT     float64 = 0.01
+	MAX_LINE_VIOLATIONS        int     = 1
 	HORIZONTAL_SLOPE_THRESHOLD float64 = 0.005
 	TREND_LINE                 string  = "Trend Line"
 	TREND_CHANNEL_LINE         string  = "Trend Channel Line"
 	SUPPORT                    string  = "Support"
+	RESISTANCE                 string  = "Resistance"
+	INSIDE_ZONE                string  = "Inside"
+	LONG_SIDE                  string  = "long"
+	SHORT_SIDE                 string  = "short"
+	BOTH_SIDES                 string  = "both"
 	SUPPORT_RANGE_PERCENT      float64 = 0.00
+	LEVEL_PIVOTS               string  = "pivots"
+	LEVEL_ZONES                string  = "zones"
+	ZONE_PIVOT_WIDTH           int     = 5
+	ZONE_ATR_MULTIPLE          float64 = 0.5
 	NUM_INTERSECTIONS_REQUIRED int     = 2
+	TIME_LAYOUT                string  = "2006-01-02"
+	HOLIDAYS_FILE              string  = "/Users/albert/Desktop/stocks/holidays.txt"
+	PROJECTION_SESSIONS        int     = 5
+
+	// Market Regime Configuration
+	IBD_DATA_FILE         string = "/Users/albert/Desktop/stocks/IBD_data.txt"
+	REGIME_OFF            string = "off"
+	REGIME_ANNOTATE       string = "annotate"
+	REGIME_SUPPRESS       string = "suppress"
+	UPTREND               string = "Uptrend"
+	MIXED                 string = "Mixed"
+	DOWNTREND             string = "Downtrend"
+	UNKNOWN_REGIME        string = "Unknown"
+	REGIME_MAX_STALE_DAYS int    = 7
+
+	// Fundamental Screen Configuration
+	FUNDAMENTALS_FILE      string = "/Users/albert/Desktop/stocks/fundamentals.csv"
+	FUNDAMENTAL_RULES_FILE string = "/Users/albert/Desktop/stocks/fundamental_rules.txt"
+	OUTPUT_SCREEN_FILE     string = "/Users/albert/Desktop/stocks/output/%s_screen.txt"
+
+	// Chart Configuration
+	CHART_WIDTH         int = 1200
+	CHART_HEIGHT        int = 600
+	CHART_MARGIN        int = 60
+	CHART_LABEL_SPACING int = 20
+
+	// Setup Score Configuration
+	MIN_SETUP_SCORE         float64 = 0
+	MAX_TOUCHES             int     = 5
+	MAX_SLOPE_ATR_PER_BAR   float64 = 0.5
+	CONFLUENCE_ATR_MULTIPLE float64 = 1.0
+	SUPPORT_ATR_MULTIPLE    float64 = 1.0
+	MAX_VOLUME_RATIO        float64 = 2.0
+
+	// Signal Study Configuration
+	STUDY_YEARS              int    = 3
+	STUDY_HORIZONS           string = "5,10,20"
+	STUDY_MIN_BARS           int    = 100
+	OUTPUT_STUDY_FILE        string = "/Users/albert/Desktop/stocks/output/%s_study.txt"
+	OUTPUT_STUDY_EVENTS_FILE string = "/Users/albert/Desktop/stocks/output/%s_study_events.csv"
+
+	// Multi-Timeframe Configuration
+	DAILY              string  = "daily"
+	WEEKLY             string  = "weekly"
+	MONTHLY            string  = "monthly"
+	WEEKLY_YEARS_DATA  int     = 5
+	MONTHLY_YEARS_DATA int     = 20
+	ALIGN_ATR_MULTIPLE float64 = 1
+
+	// Intraday Configuration
+	INTRADAY_DATA_FILE    string = "/Users/albert/Desktop/stocks/intraday/%s.csv"
+	INTRADAY_TIME_LAYOUT  string = "2006-01-02 15:04"
+	EXCHANGE_TIMEZONE     string = "America/New_York"
+	REGULAR_HOURS         string = "regular"
+	EXTENDED_HOURS        string = "extended"
+	REGULAR_OPEN_MINUTE   int    = 9*60 + 30
+	REGULAR_CLOSE_MINUTE  int    = 16 * 60
+	EXTENDED_OPEN_MINUTE  int    = 4 * 60
+	EXTENDED_CLOSE_MINUTE int    = 20 * 60
+
+	// Approaching Line Configuration
+	APPROACH_ATR_MULTIPLE float64 = 1
+	VELOCITY_LOOKBACK     int     = 5
+	OUTPUT_APPROACH_FILE  string  = "/Users/albert/Desktop/stocks/output/%s_approaching.csv"
+
+	// Chart Pattern Configuration
+	DOUBLE_BOTTOM          string  = "Double Bottom"
+	DOUBLE_TOP             string  = "Double Top"
+	HIGHER_HIGHS_LOWS      string  = "Higher Highs and Higher Lows"
+	LOWER_HIGHS_LOWS       string  = "Lower Highs and Lower Lows"
+	ASCENDING_TRIANGLE     string  = "Ascending Triangle"
+	DESCENDING_TRIANGLE    string  = "Descending Triangle"
+	SYMMETRICAL_TRIANGLE   string  = "Symmetrical Triangle"
+	RISING_WEDGE           string  = "Rising Wedge"
+	FALLING_WEDGE          string  = "Falling Wedge"
+	BULL_FLAG              string  = "Bull Flag"
+	BEAR_FLAG              string  = "Bear Flag"
+	RANGE_BREAKOUT         string  = "Range Breakout"
+	RANGE_BREAKDOWN        string  = "Range Breakdown"
+	BULLISH                string  = "Bullish"
+	BEARISH                string  = "Bearish"
+	PATTERN_LOOKBACK       int     = 60
+	DOUBLE_ATR_MULTIPLE    float64 = 0.5
+	DOUBLE_MIN_DEPTH_ATR   float64 = 1.5
+	FLAT_SLOPE_ATR_PER_BAR float64 = 0.02
+	FLAG_POLE_BARS         int     = 10
+	FLAG_POLE_ATR          float64 = 3
+	RANGE_BARS             int     = 20
+	MAX_RANGE_ATR          float64 = 4
+
+	// Bar Pattern Configuration
+	HAMMER                   string  = "Hammer"
+	SHOOTING_STAR            string  = "Shooting Star"
+	BULLISH_ENGULFING        string  = "Bullish Engulfing"
+	BEARISH_ENGULFING        string  = "Bearish Engulfing"
+	INSIDE_BAR               string  = "Inside Bar"
+	OUTSIDE_BAR              string  = "Outside Bar"
+	BULLISH_OUTSIDE_REVERSAL string  = "Bullish Outside Reversal"
+	BEARISH_OUTSIDE_REVERSAL string  = "Bearish Outside Reversal"
+	PIN_WICK_RATIO           float64 = 2
+	PIN_WICK_FRACTION        float64 = 0.6
+	REACTION_ANY             string  = "any"
+	REACTION_REVERSAL        string  = "reversal"
+	REACTION_HOLD            string  = "hold"
+	REACTION_THROUGH         string  = "through"
+
+	// Line Break Configuration
+	BREAK_TOUCH        string  = "touch"
+	BREAK_CLOSE        string  = "break"
+	BREAK_FAILED       string  = "failed break"
+	BREAK_GAP_THROUGH  string  = "gap-through"
+	BREAK_ATR_MULTIPLE float64 = 0.25
+	TREND_LINE_BREAK   string  = "Trend Line Break"
+
+	// Relative Strength Rating Configuration
+	// the year lookback is kept a little short of 252 sessions so that
+	// NUM_YEARS_DATA of daily bars covers it
+	RS_RATING_QUARTER_BARS   int     = 63
+	RS_RATING_HALF_BARS      int     = 126
+	RS_RATING_YEAR_BARS      int     = 250
+	RS_RATING_QUARTER_WEIGHT float64 = 2
+	RS_RATING_HALF_WEIGHT    float64 = 1
+	RS_RATING_YEAR_WEIGHT    float64 = 1
+	MIN_RS_RATING            float64 = 0
+	RS_RATING_FILTER         string  = "RS Rating"
+
+	// Industry Group Configuration
+	SYMBOL_METADATA_FILE string = "/Users/albert/Desktop/stocks/symbol_metadata.csv"
+	UNCLASSIFIED         string = "Unclassified"
+	SHORT_MA_BARS        int    = 50
+	LONG_MA_BARS         int    = 200
+
+	// Watchlist Configuration
+	WATCHLIST_FILE        string = "/Users/albert/Desktop/stocks/watchlist.json"
+	OUTPUT_WATCHLIST_FILE string = "/Users/albert/Desktop/stocks/output/%s_watchlist.csv"
+	WATCH_ACTIVE          string = "active"
+	WATCH_TRIGGERED       string = "triggered"
+	WATCH_INVALIDATED     string = "invalidated"
+
+	// Universe Configuration
+	UNIVERSES_FILE       string = "/Users/albert/Desktop/stocks/universes.txt"
+	UNIVERSE_FILE        string = "/Users/albert/Desktop/stocks/universes/%s.txt"
+	OUTPUT_UNIVERSE_FILE string = "/Users/albert/Desktop/stocks/output/%s_universe.txt"
+	SYMBOL_CHANGES_FILE  string = "/Users/albert/Desktop/stocks/symbol_changes.csv"
+	CACHE_DIR            string = "/Users/albert/Desktop/stocks/cache"
+	DEFAULT_UNIVERSE     string = "default"
+	SYMBOL_DELISTED      string = "delisted"
+	SYMBOL_RENAMED       string = "renamed"
+	NO_CACHED_DATA       string = "No Cached Data"
+	METADATA_FILTER      string = "Sector, Industry or Exchange"
+
+	// Technical Pre-Filter Configuration
+	ATR_WINDOW            int     = 14
+	FILTER_LOOKBACK       int     = 50
+	RS_INDEX              string  = "SPY"
+	RS_LOOKBACK           int     = 126
+	GAP_PERCENT           float64 = 0.05
+	MIN_AVG_DOLLAR_VOLUME float64 = 5000000
+	MIN_PRICE             float64 = 5
+	MIN_BAR_COUNT         int     = 200
+	MAX_GAP_COUNT         int     = 10
+	MIN_ATR_PERCENT       float64 = 0.01
+	MAX_ATR_PERCENT       float64 = 0.08
+	MIN_RELATIVE_STRENGTH float64 = 1.0
+)
+
+var (
+	scanSide = flag.String("side", LONG_SIDE, "setups to scan for: long (low pivots), short (high pivots) or both")
+
+	regimeMode = flag.String("regime", REGIME_OFF, "market regime usage: off, annotate or suppress (drops setups against the regime)")
+	regimeFile = flag.String("regime-file", IBD_DATA_FILE, "path to the IBD market direction series")
+
+	approachATR      = flag.Float64("approach-atr", APPROACH_ATR_MULTIPLE, "report lines within this many ATRs of the last close, 0 to disable")
+	velocityLookback = flag.Int("velocity-bars", VELOCITY_LOOKBACK, "bars used to estimate the price velocity toward a line")
+
+	brokenToday    = flag.Bool("breaks", false, "report trend lines the last bar closed or gapped beyond instead of bounce setups")
+	reactionFilter = flag.String("reaction", REACTION_ANY, "required reaction of the last bar to setup lines: any, hold or reversal")
+
+	levelSource = flag.String("levels", LEVEL_PIVOTS, "support/resistance levels: pivots (one per pivot in today's range) or zones (clustered pivots)")
+	zoneATR     = flag.Float64("zone-atr", ZONE_ATR_MULTIPLE, "pivots within this many ATRs are clustered into one zone")
+
+	timeframe      = flag.String("timeframe", DAILY, "bars to detect pivots and lines on: daily, weekly, monthly or an intraday interval such as 5m or 1h")
+	alignTimeframe = flag.String("align", "", "report setups that align with lines and zones of a higher timeframe")
+	requireAlign   = flag.Bool("require-align", false, "drop setups that do not align with the -align timeframe")
+
+	holidaysFile       = flag.String("holidays", HOLIDAYS_FILE, "exchange holidays, one YYYY-MM-DD date per line")
+	projectionSessions = flag.Int("project", PROJECTION_SESSIONS, "trading sessions past the last bar to project lines to")
+
+	intradayFile  = flag.String("intraday-data", INTRADAY_DATA_FILE, "intraday CSV per symbol (timestamp,open,high,low,close,volume), %s is the symbol")
+	intradayHours = flag.String("hours", REGULAR_HOURS, "intraday bars to keep: regular (09:30-16:00) or extended (04:00-20:00) hours")
+
+	screenFundamentalsFlag = flag.Bool("screen", false, "only analyze symbols that pass the fundamental screen")
+	fundamentalsFile       = flag.String("fundamentals", FUNDAMENTALS_FILE, "fundamentals snapshot (.csv or .json)")
+	fundamentalRulesFile   = flag.String("rules", FUNDAMENTAL_RULES_FILE, "fundamental screen rules")
+
+	prefilter           = flag.Bool("prefilter", false, "drop symbols that fail the technical pre-filters before line analysis")
+	minDollarVolume     = flag.Float64("min-dollar-volume", MIN_AVG_DOLLAR_VOLUME, "minimum average dollar volume over the filter lookback")
+	minPrice            = flag.Float64("min-price", MIN_PRICE, "minimum last close")
+	minBars             = flag.Int("min-bars", MIN_BAR_COUNT, "minimum number of bars")
+	maxGaps             = flag.Int("max-gaps", MAX_GAP_COUNT, "maximum number of opening gaps larger than GAP_PERCENT")
+	minATRPercent       = flag.Float64("min-atr-pct", MIN_ATR_PERCENT, "minimum ATR as a fraction of the last close")
+	maxATRPercent       = flag.Float64("max-atr-pct", MAX_ATR_PERCENT, "maximum ATR as a fraction of the last close")
+	minRelativeStrength = flag.Float64("min-rs", MIN_RELATIVE_STRENGTH, "minimum return ratio versus RS_INDEX over RS_LOOKBACK bars (0 disables)")
+	minRSRating         = flag.Float64("min-rs-rating", MIN_RS_RATING, "minimum RS rating (1-99) versus RS_INDEX across the scanned symbols (0 disables)")
+
+	groupOutput  = flag.Bool("groups", false, "group the report by industry, rank the industry groups and check the selected symbols against the portfolio rules")
+	metadataFile = flag.String("metadata", SYMBOL_METADATA_FILE, "symbol metadata CSV with symbol, sector, industry and exchange columns")
+
+	watchlistFile = flag.String("watchlist", WATCHLIST_FILE, "watchlist store every scan records its setups in, empty to disable")
+
+	universeName      = flag.String("universe", "", "named universe from -universes or a symbol file to scan (default STOCK_FILE)")
+	universesFile     = flag.String("universes", UNIVERSES_FILE, "named universes, one \"<name> <file>\" per line")
+	symbolChangesFile = flag.String("symbol-changes", SYMBOL_CHANGES_FILE, "delisted and renamed symbols: symbol, event, date and new_symbol columns")
+	asOfDate          = flag.String("as-of", "", "date delistings and renames are applied as of, YYYY-MM-DD (default today)")
+	cacheDir          = flag.String("cache", CACHE_DIR, "directory daily downloads are cached in for universe builds, empty to disable")
+	sectorFilter      = flag.String("sector", "", "universe build: only keep symbols of this sector")
+	industryFilter    = flag.String("industry", "", "universe build: only keep symbols of this industry")
+	exchangeFilter    = flag.String("exchange", "", "universe build: only keep symbols listed on this exchange")
+
+	renderCharts = flag.Bool("charts", false, "render an SVG chart for every selected symbol")
+
+	provisionalPivots = flag.Bool("provisional", false, "also use recent pivots that are not yet confirmed, at lower confidence")
+	pivotMethod       = flag.String("pivots", WINDOW_DETECTOR, "pivot detector: window, zigzag, percent or fractal")
+	pivotTies         = flag.String("ties", TIES_ALL, "which of several equal extremes are pivots: all, first or last")
+
+	lineFit          = flag.String("line-fit", STRICT_FIT, "line fitting: strict (no pivot beyond a line) or tolerance")
+	toleranceType    = flag.String("tolerance-type", ATR_TOLERANCE, "unit of the line tolerance band: atr or percent")
+	toleranceATR     = flag.Float64("tolerance-atr", LINE_TOLERANCE_ATR, "line tolerance band in ATRs")
+	tolerancePercent = flag.Float64("tolerance-pct", LINE_TOLERANCE_PERCENT, "line tolerance band as a fraction of price")
+	logScale         = flag.Bool("log-scale", false, "construct and project lines in log-price space")
+	maxViolations    = flag.Int("max-violations", MAX_LINE_VIOLATIONS, "pivots allowed past the tolerance band with -line-fit=tolerance")
+
+	study          = flag.Bool("study", false, "replay every symbol's history bar by bar and measure the forward returns of past setups")
+	studyYears     = flag.Int("study-years", STUDY_YEARS, "years of history to replay in a study")
+	studyHorizons  = flag.String("horizons", STUDY_HORIZONS, "comma separated forward return horizons in bars")
+	membershipFile = flag.String("membership", "", "point-in-time universe for a study: CSV with symbol, listed and delisted dates")
+
+	scoreWeightsFile = flag.String("weights", "", "JSON file overriding DEFAULT_SCORE_WEIGHTS, e.g. {\"touches\": 3}")
+	minScore         = flag.Float64("min-score", MIN_SETUP_SCORE, "minimum setup score (0-100) to report")
 )
 
+// weights of the setup score components. only their ratios matter.
+var DEFAULT_SCORE_WEIGHTS = ScoreWeights{
+	Touches:       2.0,
+	Age:           1.0,
+	Length:        1.0,
+	Slope:         1.0,
+	Confluence:    2.0,
+	Support:       1.5,
+	Volume:        1.0,
+	CloseLocation: 1.0,
+	Reaction:      1.5,
+	RSRating:      0.0,
+}
+
+var scoreWeights = DEFAULT_SCORE_WEIGHTS
+
+// RS ratings of the scanned symbols, filled in before any of them is analyzed
+var rsRatings = make(map[string]float64)
+
+var pivotDetector PivotDetector = WindowPivotDetector{TIES_ALL}
+
+// Line is drawn through the bars at X1 and X2. its geometry is measured in
+// trading sessions (S1 and S2) rather than bar positions so that missing bars
+// do not bend it and it can be projected to future dates.
 type Line struct {
-	X1 int
-	Y1 float64
-	X2 int
-	Y2 float64
+	X1          int
+	Y1          float64
+	X2          int
+	Y2          float64
+	S1          int
+	S2          int
+	Provisional bool
+	Confidence  float64
+	Touches     int
+	LastTouch   int
+	Violations  int
+	LogScale    bool
 }
 
+// Pivot is a local extreme at Index that can only be known once the bar at
+// Confirmed has closed. provisional pivots are recent extremes that do not yet
+// have enough bars on their right; their confidence is the fraction of those
+// bars seen so far.
+type Pivot struct {
+	Index       int
+	Confirmed   int
+	Provisional bool
+	Confidence  float64
+}
+
+// Intersection is a line the last bar crossed or gapped through. Reaction
+// describes how the bar responded to the line: a reversal bar pattern in the
+// setup's direction, a close on the setup's side of the line (hold) or a close
+// through it. Break classifies how far the bar went beyond the line.
 type Intersection struct {
-	Line  Line
-	Price float64
-	Date  string
-	Type  string
+	Line          Line
+	Price         float64
+	Date          string
+	Type          string
+	Reaction      string
+	BarPatterns   []string
+	CloseLocation float64
+	Break         string
 }
 
+// StockData is a series of daily bars unless it was resampled to a higher
+// Timeframe
 type StockData struct {
-	Data   []StockBar
-	Symbol string
+	Data       []StockBar
+	Symbol     string
+	Timeframe  string
+	PivotCache *PivotCache
+}
+
+// PivotCache holds the pivots of a stock's full history while a study replays
+// it, so that every replayed bar does not search its whole history again
+type PivotCache struct {
+	Stock  *StockData
+	Pivots map[PivotKey][]Pivot
+}
+
+type PivotKey struct {
+	High  bool
+	Width int
 }
 
 type StockBar struct {
 	Date     string
+	Time     time.Time
+	Session  int
 	Open     float64
 	High     float64
 	Low      float64
 	Close    float64
 	Volume   int
 	AdjClose float64
+	ATR      float64
+	Partial  bool
+}
+
+type TechnicalFilter struct {
+	Name   string
+	Passes func(stock *StockData) bool
 }
 
+// log-scale lines are straight in log-price space so their slope is the
+// change in log price per session
 func (l *Line) Slope() float64 {
-	return (l.Y2 - l.Y1) / float64(l.X2-l.X1)
+	if l.LogScale {
+		return (math.Log(l.Y2) - math.Log(l.Y1)) / float64(l.S2-l.S1)
+	}
+	return (l.Y2 - l.Y1) / float64(l.S2-l.S1)
+}
+
+// returns the slope as percent per session. constant along log-scale lines and
+// measured from the start price of linear ones
+func (l *Line) SlopePercent() float64 {
+	if l.LogScale {
+		return (math.Exp(l.Slope()) - 1) * 100
+	}
+	return l.Slope() / l.Y1 * 100
 }
 
-func (l *Line) Crosses(x int, high, low float64) (float64, bool) {
-	projection := l.GetProjection(x)
+// returns the change in price per session at the given session
+func (l *Line) PriceSlope(session int) float64 {
+	return l.GetProjection(session+1) - l.GetProjection(session)
+}
+
+func (l *Line) Crosses(session int, high, low float64) (float64, bool) {
+	projection := l.GetProjection(session)
 	return projection, projection <= high && projection >= low
 }
 
-func (l *Line) GetProjection(x int) float64 {
-	return l.Y1 + (l.Slope() * float64(x-l.X1))
+// returns the line's price at a trading session, see StockBar.Session
+func (l *Line) GetProjection(session int) float64 {
+	if l.LogScale {
+		return l.Y1 * math.Exp(l.Slope()*float64(session-l.S1))
+	}
+	return l.Y1 + (l.Slope() * float64(session-l.S1))
+}
+
+// returns the line's price on a date after the stock's last bar, counting
+// the trading sessions (or weeks or months on resampled data) in between with
+// the calendar
+func (l *Line) ProjectDate(stock *StockData, calendar *TradingCalendar, date time.Time) float64 {
+	lastBar := stock.Data[len(stock.Data)-1]
+	return l.GetProjection(lastBar.Session + calendar.CountPeriods(lastBar.Time, date, stock.Timeframe))
 }
 
 func (l *Line) ToString(stock *StockData) string {
@@ -80,367 +463,5138 @@ func (l *Line) ToString(stock *StockData) string {
 	return str
 }
 
-func (l *Line) NoPivotsBelow(stock *StockData, pivots []int) bool {
+func (l *Line) NoPivotsBelow(stock *StockData, pivots []Pivot) bool {
 	for _, pivot := range pivots {
-		projection := l.GetProjection(pivot)
-		if stock.Data[pivot].Low < projection {
+		projection := l.GetProjection(stock.Data[pivot.Index].Session)
+		if stock.Data[pivot.Index].Low < projection {
 			return false
 		}
 	}
 	return true
 }
 
-func (l *Line) NoPivotsAbove(stock *StockData, pivots []int) bool {
+// in strict mode a line may not have any pivot beyond it. with
+// -line-fit=tolerance, pivots beyond the line but within the tolerance band
+// count as touches and up to -max-violations pivots may lie past the band.
+func (l *Line) FitsPivots(stock *StockData, pivots []Pivot, getHighLines bool) bool {
+	if *lineFit == STRICT_FIT {
+		if getHighLines {
+			return l.NoPivotsAbove(stock, pivots)
+		}
+		return l.NoPivotsBelow(stock, pivots)
+	}
+	return l.CountViolations(stock, pivots, getHighLines) <= *maxViolations
+}
+
+// counts the pivots from the line's start that lie beyond the line by more
+// than the tolerance band. in strict mode any pivot beyond the line is a
+// violation.
+func (l *Line) CountViolations(stock *StockData, pivots []Pivot, getHighLines bool) int {
+	violations := 0
+	for _, pivot := range pivots {
+		if pivot.Index < l.X1 {
+			continue
+		}
+		projection := l.GetProjection(stock.Data[pivot.Index].Session)
+		tolerance := 0.0
+		if *lineFit != STRICT_FIT {
+			tolerance = getLineTolerance(stock, pivot.Index, projection)
+		}
+		if getHighLines {
+			if stock.Data[pivot.Index].High > projection+tolerance {
+				violations++
+			}
+		} else {
+			if stock.Data[pivot.Index].Low < projection-tolerance {
+				violations++
+			}
+		}
+	}
+	return violations
+}
+
+func (l *Line) NoPivotsAbove(stock *StockData, pivots []Pivot) bool {
 	for _, pivot := range pivots {
-		projection := l.GetProjection(pivot)
-		if stock.Data[pivot].High > projection {
+		projection := l.GetProjection(stock.Data[pivot.Index].Session)
+		if stock.Data[pivot.Index].High > projection {
 			return false
 		}
 	}
 	return true
 }
 
-func main() {
-	t := time.Now()
-	month := fmt.Sprintf("%02d", t.Month()-1)
-	itoa := strconv.Itoa
+type MarketRegime struct {
+	Days []RegimeDay
+}
 
-	var c chan interface{} = make(chan interface{}, 1)
+type RegimeDay struct {
+	Date  time.Time
+	Value float64
+}
 
-	file, err := os.Open(STOCK_FILE)
-	if err != nil {
-		log.Fatal(err)
+// returns the latest regime reading on or before the given date. readings more
+// than REGIME_MAX_STALE_DAYS old are not used.
+func (r *MarketRegime) GetRegime(date time.Time) (RegimeDay, bool) {
+	i := sort.Search(len(r.Days), func(i int) bool {
+		return r.Days[i].Date.After(date)
+	})
+	if i == 0 {
+		return RegimeDay{}, false
 	}
-	defer file.Close()
+	day := r.Days[i-1]
+	if date.Sub(day.Date) > time.Duration(REGIME_MAX_STALE_DAYS)*24*time.Hour {
+		return RegimeDay{}, false
+	}
+	return day, true
+}
 
-	numLines := 0
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		symbol := scanner.Text()
-		numLines++
-		go getStockData(c, symbol, month, itoa(t.Day()), itoa(t.Year()), month, itoa(t.Day()), itoa(t.Year()-NUM_YEARS_DATA))
+// returns the regime label for the stock's last bar
+func (r *MarketRegime) GetStockRegime(stock *StockData) (RegimeDay, string) {
+	day, ok := r.GetRegime(stock.Data[len(stock.Data)-1].Time)
+	if !ok {
+		return RegimeDay{}, UNKNOWN_REGIME
 	}
+	return day, getRegimeLabel(day.Value)
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+func getRegimeLabel(value float64) string {
+	if value >= 1 {
+		return UPTREND
+	} else if value < 0 {
+		return DOWNTREND
 	}
+	return MIXED
+}
 
-	output := ""
-	outputSymbols := ""
-	for i := 1; i <= numLines; i++ {
-		data := <-c
-		if data != nil {
-			stock := data.(StockData)
-			fmt.Printf("(%d/%d) Evaluating %s...\n", i, numLines, stock.Symbol)
-
-			// Trend Channel Line overshoot only, must check if stock price decreased
-			if true || stockDecreased(stock) {
-				trendChannelLines, trendLines, horizontalLines := getLines(&stock, false)
-				tclInts, tlInts := getAllIntersections(&stock, trendChannelLines, trendLines)
-				setup, ok := getBestSetup(tclInts, tlInts, len(horizontalLines))
-				if ok {
-					output += fmt.Sprintf("=============== %s ===============\n", stock.Symbol)
-					output += "++++++++++++ Best Setup ++++++++++++\n"
-					outputSymbols += stock.Symbol + "\n"
-					for _, intersection := range setup {
-						output += fmt.Sprintf("----- %s -----\n", intersection.Type)
-						output += intersection.Line.ToString(&stock)
-						output += fmt.Sprintf("Crosses $%.2f on %s\n", intersection.Price, intersection.Date)
-					}
+// parses the IBD market direction series, which is stored as a javascript
+// array literal: var cbti_array = [[unix_ts, value], ...];
+func loadMarketRegime(filename string) (*MarketRegime, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
 
-					// TODO support experiment
-					for _, currLine := range horizontalLines {
-						output += fmt.Sprintf("----- %s -----\n", "Support")
-						output += fmt.Sprintf("Support at $%.2f\n", currLine.Y1)
-					}
+	text := string(raw)
+	start := strings.Index(text, "[")
+	end := strings.LastIndex(text, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%s: no regime array found", filename)
+	}
 
-					// print all data
-					output += "++++++++++++ All Lines ++++++++++++\n"
-					lines := [][]Intersection{tclInts, tlInts} //, hInts}
-					for _, set := range lines {
-						for _, intersection := range set {
-							output += fmt.Sprintf("----- %s -----\n", intersection.Type)
-							output += intersection.Line.ToString(&stock)
-							output += fmt.Sprintf("Crosses $%.2f on %s\n", intersection.Price, intersection.Date)
-						}
-					}
+	var points [][]float64
+	if err := json.Unmarshal([]byte(text[start:end+1]), &points); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
 
-					// TODO support experiment
-					for _, currLine := range horizontalLines {
-						output += fmt.Sprintf("----- %s -----\n", "Support")
-						output += fmt.Sprintf("Support at $%.2f\n", currLine.Y1)
-					}
-				}
-			}
-		} else {
-			fmt.Printf("(%d/%d) Evaluating...\n", i, numLines)
+	regime := MarketRegime{}
+	for _, point := range points {
+		if len(point) != 2 {
+			return nil, fmt.Errorf("%s: malformed regime entry %v", filename, point)
 		}
+		regime.Days = append(regime.Days, RegimeDay{time.Unix(int64(point[0]), 0).UTC(), point[1]})
 	}
+	sort.Slice(regime.Days, func(i, j int) bool {
+		return regime.Days[i].Date.Before(regime.Days[j].Date)
+	})
 
-	fmt.Println(outputSymbols)
-
-	// write to file
-	outputBytes := []byte(output)
-	outputSymbolsBytes := []byte(outputSymbols)
-
-	outputErr := ioutil.WriteFile(fmt.Sprintf(OUTPUT_FILE, t.Format("01-02-2006")), outputBytes, 0644)
-	outputSymbolsErr := ioutil.WriteFile(fmt.Sprintf(OUTPUT_SYMBOLS_FILE, t.Format("01-02-2006")), outputSymbolsBytes, 0644)
-	if outputErr != nil || outputSymbolsErr != nil {
-		fmt.Println("ERROR writing to file!")
-	} else {
-		fmt.Println("DONE!")
-	}
+	return &regime, nil
 }
 
-func stockDecreased(stock StockData) bool {
-	data := stock.Data
-	return data[len(data)-1].Close < data[len(data)-2].Close
+// TradingCalendar knows which days the exchange is open: weekdays that are not
+// listed holidays. Open and Close are the minutes of the day (exchange time)
+// intraday bars are kept between. FirstYear and LastYear are the years the
+// holiday list covers.
+type TradingCalendar struct {
+	Holidays  map[string]bool
+	Open      int
+	Close     int
+	FirstYear int
+	LastYear  int
 }
 
-// func getBestSetup(trendChannelLineIntersections, trendLineIntersections, horizontalLineIntersections []Intersection) ([]Intersection, bool) {
-// 	var bestPair []Intersection
-// 	bestRange := math.MaxFloat64
-
-// 	for _, tcl := range trendChannelLineIntersections {
-// 		for _, tl := range trendLineIntersections {
-// 			currRange, currPair := getPairRange(tcl, tl)
-// 			if currRange < bestRange {
-// 				bestRange = currRange
-// 				bestPair = currPair
-// 			}
-// 		}
-// 	}
+var tradingCalendar = TradingCalendar{Holidays: make(map[string]bool), Open: REGULAR_OPEN_MINUTE, Close: REGULAR_CLOSE_MINUTE}
 
-// 	setup := append(bestPair, horizontalLineIntersections...)
+// reports whether the holiday list covers every day from start to end.
+// outside it, holidays are counted as trading sessions.
+func (c *TradingCalendar) Covers(start, end time.Time) bool {
+	return len(c.Holidays) > 0 && start.Year() >= c.FirstYear && end.Year() <= c.LastYear
+}
 
-// 	return setup, len(setup)-len(horizontalLineIntersections) >= NUM_INTERSECTIONS_REQUIRED
-// }
+func (c *TradingCalendar) IsTradingDay(date time.Time) bool {
+	if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		return false
+	}
+	return !c.Holidays[date.Format(TIME_LAYOUT)]
+}
 
-func getBestSetup(trendChannelLineIntersections, trendLineIntersections []Intersection, numHorizontalLines int) ([]Intersection, bool) {
-	var bestPair []Intersection
-	var setup []Intersection
-	bestRange := math.MaxFloat64
+// returns the number of trading sessions after from up to and including to,
+// negative when to is before from
+func (c *TradingCalendar) CountSessions(from, to time.Time) int {
+	if to.Before(from) {
+		return -c.CountSessions(to, from)
+	}
+	sessions := 0
+	for day := from.AddDate(0, 0, 1); !day.After(to); day = day.AddDate(0, 0, 1) {
+		if c.IsTradingDay(day) {
+			sessions++
+		}
+	}
+	return sessions
+}
 
-	for _, tcl := range trendChannelLineIntersections {
-		for _, tl := range trendLineIntersections {
-			currRange, currPair := getPairRange(tcl, tl)
-			if currRange < bestRange {
-				bestRange = currRange
-				bestPair = currPair
-			}
+// returns the date of the nth trading session after date
+func (c *TradingCalendar) AddSessions(date time.Time, n int) time.Time {
+	for n > 0 {
+		date = date.AddDate(0, 0, 1)
+		if c.IsTradingDay(date) {
+			n--
 		}
 	}
+	return date
+}
 
-	// return one trend channel line
-	if len(bestPair) == 0 && numHorizontalLines > 0 {
-		setup = trendChannelLineIntersections
-	} else {
-		setup = bestPair
+// reports whether an intraday bar starting at t falls within the trading hours
+// of a trading day
+func (c *TradingCalendar) IsTradingTime(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	return c.IsTradingDay(t) && minute >= c.Open && minute < c.Close
+}
+
+// returns the slot of the day's trading hours an intraday bar starting at t
+// falls in, counting from zero at the open
+func (c *TradingCalendar) getSlot(t time.Time, interval time.Duration) int {
+	minutes := t.Hour()*60 + t.Minute() - c.Open
+	if minutes < 0 {
+		return 0
 	}
+	return minutes / int(interval/time.Minute)
+}
 
-	return setup, len(setup) > 0
+// returns the number of intraday bars of the interval the trading hours hold
+func (c *TradingCalendar) BarsPerSession(interval time.Duration) int {
+	step := int(interval / time.Minute)
+	return (c.Close - c.Open + step - 1) / step
 }
 
-func getPairRange(tclIntersection, tlIntersection Intersection) (float64, []Intersection) {
-	return math.Abs(tclIntersection.Price - tlIntersection.Price), []Intersection{tclIntersection, tlIntersection}
+// returns the number of intraday bars of the interval after from up to and
+// including to. only trading hours of trading days are counted.
+func (c *TradingCalendar) CountBars(from, to time.Time, interval time.Duration) int {
+	sessions := c.CountSessions(startOfDay(from), startOfDay(to))
+	return sessions*c.BarsPerSession(interval) + c.getSlot(to, interval) - c.getSlot(from, interval)
 }
 
-func getAllIntersections(stock *StockData, trendChannelLines, trendLines []Line) ([]Intersection, []Intersection) {
-	trendChannelLineIntersections := getIntersections(stock, TREND_CHANNEL_LINE, trendChannelLines)
-	trendLineIntersections := getIntersections(stock, TREND_LINE, trendLines)
+// returns the start of the nth intraday bar of the interval after t
+func (c *TradingCalendar) AddBars(t time.Time, n int, interval time.Duration) time.Time {
+	perSession := c.BarsPerSession(interval)
+	slot := c.getSlot(t, interval) + n
+	day := c.AddSessions(startOfDay(t), slot/perSession)
+	return day.Add(time.Duration(c.Open)*time.Minute + time.Duration(slot%perSession)*interval)
+}
 
-	return trendChannelLineIntersections, trendLineIntersections
+// returns the number of periods of the timeframe after from up to and
+// including to: trading sessions for daily data, intraday bars for intraday
+// data, otherwise calendar weeks or months
+func (c *TradingCalendar) CountPeriods(from, to time.Time, timeframe string) int {
+	if interval, ok := getIntradayInterval(timeframe); ok {
+		return c.CountBars(from, to, interval)
+	}
+	switch timeframe {
+	case WEEKLY:
+		monday := func(date time.Time) time.Time {
+			return date.AddDate(0, 0, -((int(date.Weekday()) + 6) % 7))
+		}
+		return int(math.Round(monday(to).Sub(monday(from)).Hours() / 24 / 7))
+	case MONTHLY:
+		return (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month())
+	}
+	return c.CountSessions(from, to)
 }
 
-// func getAllIntersections(stock *StockData, trendChannelLines, trendLines, horizontalLines []Line) ([]Intersection, []Intersection, []Intersection) {
-// 	trendChannelLineIntersections := getIntersections(stock, TREND_CHANNEL_LINE, trendChannelLines)
-// 	trendLineIntersections := getIntersections(stock, TREND_LINE, trendLines)
-// 	horizontalLineIntersections := getIntersections(stock, SUPPORT, horizontalLines)
+// numbers the stock's bars by trading session (or period on resampled data),
+// starting from zero at the first bar. a bar missing from the data leaves a
+// gap in the numbering and a bar on a day the calendar has closed still gets
+// a session of its own.
+func (c *TradingCalendar) SetSessions(stock *StockData) {
+	for i := range stock.Data {
+		if i == 0 {
+			stock.Data[i].Session = 0
+			continue
+		}
+		sessions := c.CountPeriods(stock.Data[i-1].Time, stock.Data[i].Time, stock.Timeframe)
+		if sessions < 1 {
+			sessions = 1
+		}
+		stock.Data[i].Session = stock.Data[i-1].Session + sessions
+	}
+}
 
-// 	return trendChannelLineIntersections, trendLineIntersections, horizontalLineIntersections
-// }
+// reads exchange holidays, one date per line. anything after the date is
+// treated as a description and lines starting with # are ignored.
+func loadTradingCalendar(filename string) (TradingCalendar, error) {
+	calendar := TradingCalendar{Holidays: make(map[string]bool), Open: REGULAR_OPEN_MINUTE, Close: REGULAR_CLOSE_MINUTE}
 
-func getIntersections(stock *StockData, lineType string, lines []Line) []Intersection {
-	var intersections []Intersection
+	file, err := os.Open(filename)
+	if err != nil {
+		return calendar, err
+	}
+	defer file.Close()
 
-	lastBarIndex := len(stock.Data) - 1
-	for _, line := range lines {
-		price, crosses := line.Crosses(lastBarIndex, stock.Data[lastBarIndex].High, stock.Data[lastBarIndex].Low)
-		if crosses {
-			intersection := Intersection{line, price, stock.Data[lastBarIndex].Date, lineType}
-			intersections = append(intersections, intersection)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		date, err := time.Parse(TIME_LAYOUT, fields[0])
+		if err != nil {
+			return calendar, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+		calendar.Holidays[date.Format(TIME_LAYOUT)] = true
+		if calendar.FirstYear == 0 || date.Year() < calendar.FirstYear {
+			calendar.FirstYear = date.Year()
+		}
+		if date.Year() > calendar.LastYear {
+			calendar.LastYear = date.Year()
 		}
 	}
 
-	return intersections
+	return calendar, scanner.Err()
 }
 
-// draw lines for low pivots:
-// iteratively go through pivots
-// have an anchor pivot (use start pivots as anchor pivots)
-// create a line if a next pivot creates a line with a slope less than what's been seen so far
-
-// returns trendLines, trendChannelLines, horizontalLines
-func getLines(stock *StockData, getOverLines bool) ([]Line, []Line, []Line) {
-	startPivots := getStartPivots(stock, getOverLines)
-	endPivots := getPivots(stock, getOverLines, PIVOT_WIDTH)
-	return getLinesFromPivots(stock, startPivots, endPivots, getOverLines)
-}
+func main() {
+	flag.Parse()
+	t := time.Now()
+	month := fmt.Sprintf("%02d", t.Month()-1)
+	itoa := strconv.Itoa
 
-func getLinesFromPivots(stock *StockData, startPivots []int, pivots []int, getHighLines bool) ([]Line, []Line, []Line) {
-	var lines []Line
-	currentPivotIndex := 0
+	scanSides, err := getScanSides(*scanSide)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	for _, startPivot := range startPivots {
-		var prevLine interface{}
-		prevLine = nil
-		for j := currentPivotIndex; j < len(pivots); j++ {
-			pivot := pivots[j]
-			if pivot > startPivot {
-				if pivots[currentPivotIndex] <= startPivot {
-					currentPivotIndex = j
-				}
+	pivotDetector, err = newPivotDetector(*pivotMethod, *pivotTies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *lineFit != STRICT_FIT && *lineFit != TOLERANCE_FIT {
+		log.Fatalf("unknown line fit: %s", *lineFit)
+	}
+	if *toleranceType != ATR_TOLERANCE && *toleranceType != PERCENT_TOLERANCE {
+		log.Fatalf("unknown tolerance type: %s", *toleranceType)
+	}
+	if *reactionFilter != REACTION_ANY && *reactionFilter != REACTION_HOLD && *reactionFilter != REACTION_REVERSAL {
+		log.Fatalf("unknown reaction filter: %s", *reactionFilter)
+	}
+	if *levelSource != LEVEL_PIVOTS && *levelSource != LEVEL_ZONES {
+		log.Fatalf("unknown level source: %s", *levelSource)
+	}
 
-				// interface conversion
-				var prevLineConverted Line
-				if prevLine != nil {
-					prevLineConverted = prevLine.(Line)
-				}
+	tradingCalendar, err = loadTradingCalendar(*holidaysFile)
+	if os.IsNotExist(err) {
+		fmt.Printf("WARNING: %s not found, every weekday is counted as a trading session\n", *holidaysFile)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if flag.Arg(0) == "watchlist" {
+		if err := runWatchlistCommand(*watchlistFile, flag.Args()[1:], t); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "universe" {
+		if err := runUniverseCommand(flag.Args()[1:], t); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	switch *intradayHours {
+	case REGULAR_HOURS:
+	case EXTENDED_HOURS:
+		tradingCalendar.Open, tradingCalendar.Close = EXTENDED_OPEN_MINUTE, EXTENDED_CLOSE_MINUTE
+	default:
+		log.Fatalf("unknown trading hours: %s", *intradayHours)
+	}
 
-				// draw lines
-				if getHighLines {
-					currLine := Line{startPivot, stock.Data[startPivot].High, pivot, stock.Data[pivot].High}
-					if currLine.NoPivotsAbove(stock, pivots[j:]) && (prevLine == nil || currLine.Slope() >= prevLineConverted.Slope()) {
-						prevLine = currLine
-						lines = append(lines, currLine)
-					}
-				} else {
-					currLine := Line{startPivot, stock.Data[startPivot].Low, pivot, stock.Data[pivot].Low}
-					if currLine.NoPivotsBelow(stock, pivots[j:]) && (prevLine == nil || currLine.Slope() <= prevLineConverted.Slope()) {
-						prevLine = currLine
-						lines = append(lines, currLine)
-					}
-				}
+	numYears := NUM_YEARS_DATA
+	var horizons []int
+	if *study {
+		numYears = *studyYears
+		horizons, err = parseHorizons(*studyHorizons)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var membership map[string]*Membership
+	if *membershipFile != "" {
+		if !*study {
+			log.Fatal("-membership is only used by a study")
+		}
+		membership, err = loadMembership(*membershipFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *cacheDir == "" {
+			log.Fatal("-membership reads the bars of delisted symbols from -cache")
+		}
+	}
+	for _, frame := range []string{*timeframe, *alignTimeframe} {
+		switch frame {
+		case "", DAILY:
+		case WEEKLY:
+			numYears = int(math.Max(float64(numYears), float64(WEEKLY_YEARS_DATA)))
+		case MONTHLY:
+			numYears = int(math.Max(float64(numYears), float64(MONTHLY_YEARS_DATA)))
+		default:
+			if _, ok := getIntradayInterval(frame); !ok {
+				log.Fatalf("unknown timeframe: %s", frame)
 			}
 		}
 	}
 
-	var trendLines []Line
-	var trendChannelLines []Line
-	var horizontalLines []Line
+	// intraday timeframes are built from local intraday files instead of
+	// daily bars
+	fetch := func(c chan interface{}, symbol string) {
+		getStockData(c, symbol, month, itoa(t.Day()), itoa(t.Year()), month, itoa(t.Day()), itoa(t.Year()-numYears))
+	}
+	interval, intraday := getIntradayInterval(*timeframe)
+	if intraday {
+		fetch = getIntradayData
+	}
+	// delisted symbols can no longer be downloaded and their ticker may have
+	// been reused by another company, so a study over a point-in-time
+	// universe reads them from the cache only
+	if membership != nil && !intraday {
+		download := fetch
+		fetch = func(c chan interface{}, symbol string) {
+			if member, ok := membership[strings.ToUpper(symbol)]; !ok || member.Delisted == "" {
+				download(c, symbol)
+				return
+			}
+			data, err := loadCachedStockData(symbol)
+			if err != nil {
+				fmt.Printf("Unable to read cached data for %s: %v\n", symbol, err)
+				c <- nil
+				return
+			}
+			c <- data
+		}
+	}
+	notAligned := 0
+	var studyEvents []StudyEvent
 
-	if getHighLines {
-		// get resistance lines
-	} else {
-		horizontalLines = getSupport(stock)
+	if *scoreWeightsFile != "" {
+		weights, err := loadScoreWeights(*scoreWeightsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scoreWeights = weights
 	}
 
+	var marketRegime *MarketRegime
+	switch *regimeMode {
+	case REGIME_OFF:
+	case REGIME_ANNOTATE, REGIME_SUPPRESS:
+		regime, err := loadMarketRegime(*regimeFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		marketRegime = regime
+	default:
+		log.Fatalf("unknown regime mode: %s", *regimeMode)
+	}
+	setupsByRegime := make(map[string]int)
+	suppressedByRegime := 0
+
+	var fundamentalRules []FundamentalRule
+	var fundamentalsSnapshot map[string]*Fundamentals
+	if *screenFundamentalsFlag || *groupOutput {
+		// -groups checks the diversification of the selected symbols with
+		// the portfolio rules
+		rules, err := loadFundamentalRules(*fundamentalRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fundamentalRules = rules
+	}
+	if *screenFundamentalsFlag {
+		snapshot, err := loadFundamentals(*fundamentalsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fundamentalsSnapshot = snapshot
+	}
+	// RS ratings rank the symbols on the latest bars, which a study must
+	// not look ahead at. they are only computed when -min-rs-rating, the
+	// rs_rating score weight or the median RS of -groups asks for them.
+	if *minRSRating > 0 && (*study || intraday) {
+		log.Fatal("-min-rs-rating needs daily bars and is not available in a study")
+	}
+	rankRS := !*study && !intraday && (*minRSRating > 0 || scoreWeights.RSRating > 0 || *groupOutput)
+	filterRS := *prefilter && *minRelativeStrength > 0
+	var index *StockData
+	if rankRS || filterRS {
+		indexChan := make(chan interface{}, 1)
+		fetch(indexChan, RS_INDEX)
+		indexData := <-indexChan
+		if indexData != nil {
+			indexStock := indexData.(StockData)
+			index = &indexStock
+		} else if filterRS || *minRSRating > 0 {
+			log.Fatalf("unable to retrieve data for %s", RS_INDEX)
+		} else {
+			fmt.Printf("Unable to retrieve data for %s, RS ratings are not available\n", RS_INDEX)
+			rankRS = false
+		}
+	}
+	var symbolMetadata map[string]*SymbolMetadata
+	if *groupOutput {
+		symbolMetadata, err = loadSymbolMetadata(*metadataFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var technicalFilters []TechnicalFilter
+	if *prefilter {
+		if filterRS {
+			technicalFilters = getTechnicalFilters(index)
+		} else {
+			technicalFilters = getTechnicalFilters(nil)
+		}
+	}
+	removedByFilter := make(map[string]int)
+
+	screens := make(map[string]ScreenResult)
+	screenOutput := ""
+	numScreenedOut := 0
+
+	var c chan interface{} = make(chan interface{}, 1)
+
+	// a study over a point-in-time universe replays every symbol that was
+	// ever a member, delisted ones included, instead of today's universe
+	var symbols []string
+	if membership != nil {
+		symbols = getMembershipSymbols(membership)
+		fmt.Printf("Membership: %s - %d symbols\n", *membershipFile, len(symbols))
+	} else {
+		universe, err := getUniverse(*universeName, t)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(universe.Summary())
+		symbols = universe.Symbols
+	}
+
+	numLines := 0
+	for _, symbol := range symbols {
+
+		// only fetch symbols that pass the fundamental screen
+		if *screenFundamentalsFlag {
+			screen := screenFundamentals(fundamentalsSnapshot[strings.ToUpper(symbol)], fundamentalRules)
+			screen.Symbol = symbol
+			screens[symbol] = screen
+			screenOutput += screen.ToString()
+			if !screen.Passed {
+				numScreenedOut++
+				continue
+			}
+		}
+
+		numLines++
+		go fetch(c, symbol)
+	}
+
+	selected := make(map[string]bool)
+	var selectedSymbols []string
+	var results []ScanResult
+	var approaching []ApproachResult
+	load := func(i int) (StockData, bool) {
+		data := <-c
+		if data == nil {
+			fmt.Printf("(%d/%d) Loading...\n", i, numLines)
+			return StockData{}, false
+		}
+		stock := data.(StockData)
+		fmt.Printf("(%d/%d) Loaded %s...\n", i, numLines, stock.Symbol)
+		return stock, true
+	}
+
+	// RS ratings and industry groups rank the symbols against each other, so
+	// every symbol is loaded before any is analyzed when they are in use.
+	// otherwise symbols are analyzed as they arrive.
+	bufferStocks := rankRS || *groupOutput
+	var stocks []StockData
+	if bufferStocks {
+		for i := 1; i <= numLines; i++ {
+			if stock, ok := load(i); ok {
+				stocks = append(stocks, stock)
+			}
+		}
+	}
+	if rankRS {
+		rsRatings = getRSRatings(stocks, index)
+	}
+	var industryGroups map[string]*IndustryGroup
+	if *groupOutput {
+		industryGroups = getIndustryGroups(stocks, symbolMetadata)
+	}
+	var watchlist *Watchlist
+	today := t.Format(TIME_LAYOUT)
+	if *watchlistFile != "" && !*study {
+		watchlist, err = loadWatchlist(*watchlistFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		watchlist.StartScan(today)
+	}
+
+	var firstBar, lastBar time.Time
+	studied := make(map[string]bool)
+	for i := 0; i < numLines; i++ {
+		var stock StockData
+		if bufferStocks {
+			if i >= len(stocks) {
+				break
+			}
+			stock = stocks[i]
+		} else {
+			var ok bool
+			if stock, ok = load(i + 1); !ok {
+				continue
+			}
+		}
+		fmt.Printf("(%d/%d) Evaluating %s...\n", i+1, numLines, stock.Symbol)
+		if watchlist != nil {
+			watchlist.Update(&stock)
+		}
+		if len(stock.Data) > 0 {
+			if firstBar.IsZero() || stock.Data[0].Time.Before(firstBar) {
+				firstBar = stock.Data[0].Time
+			}
+			if stock.Data[len(stock.Data)-1].Time.After(lastBar) {
+				lastBar = stock.Data[len(stock.Data)-1].Time
+			}
+		}
+
+		if *study {
+			member := membership[stock.Symbol]
+			if member != nil && hasMemberBars(&stock, member) {
+				studied[stock.Symbol] = true
+			}
+			studyEvents = append(studyEvents, studyStock(&stock, member, scanSides, horizons, technicalFilters, marketRegime)...)
+			continue
+		}
+
+		if failed, ok := applyTechnicalFilters(&stock, technicalFilters); !ok {
+			removedByFilter[failed]++
+			continue
+		}
+		if *minRSRating > 0 && rsRatings[stock.Symbol] < *minRSRating {
+			removedByFilter[RS_RATING_FILTER]++
+			continue
+		}
+
+		if intraday {
+			if source, _ := getIntradayInterval(stock.Timeframe); interval%source != 0 {
+				fmt.Printf("Skipping %s: %s bars cannot be built from %s bars\n", stock.Symbol, *timeframe, stock.Timeframe)
+				continue
+			}
+		}
+
+		var higher StockData
+		if *alignTimeframe != "" {
+			higher = resample(&stock, *alignTimeframe)
+		}
+		if stock.Timeframe != *timeframe {
+			stock = resample(&stock, *timeframe)
+		}
+
+		// Trend Channel Line overshoot only, must check if stock price decreased
+		if true || stockDecreased(stock) {
+			// patterns come from the lines through both the pivot lows and
+			// highs, so both sides are analyzed whichever are scanned
+			analyses := make(map[string]StockAnalysis)
+			found := make(map[string]bool)
+			for _, side := range []string{LONG_SIDE, SHORT_SIDE} {
+				analysis, ok := analyzeStock(&stock, side)
+				analyses[side], found[side] = analysis, ok
+			}
+			lowAnalysis, highAnalysis := analyses[LONG_SIDE], analyses[SHORT_SIDE]
+			patterns := getPatterns(&stock, &lowAnalysis, &highAnalysis)
+
+			for _, side := range scanSides {
+				analysis, ok := analyses[side], found[side]
+				analysis.Patterns = getSidePatterns(patterns, side)
+				regimeDay, regimeLabel := RegimeDay{}, UNKNOWN_REGIME
+				if marketRegime != nil {
+					regimeDay, regimeLabel = marketRegime.GetStockRegime(&stock)
+					if *regimeMode == REGIME_SUPPRESS && isAgainstRegime(side, regimeLabel) {
+						if ok {
+							suppressedByRegime++
+						}
+						ok = false
+						analysis.Approaches = nil
+					}
+				}
+				for _, approach := range analysis.Approaches {
+					approaching = append(approaching, newApproachResult(&stock, side, approach))
+				}
+				var alignedLines []Intersection
+				var alignedZones []Zone
+				if ok && *alignTimeframe != "" {
+					alignedLines, alignedZones = getAlignment(&stock, &analysis, &higher)
+					if *requireAlign && len(alignedLines) == 0 && len(alignedZones) == 0 {
+						notAligned++
+						ok = false
+					}
+				}
+				if !ok {
+					continue
+				}
+
+				setupsByRegime[regimeLabel]++
+				if !selected[stock.Symbol] {
+					selected[stock.Symbol] = true
+					selectedSymbols = append(selectedSymbols, stock.Symbol)
+					if *groupOutput {
+						// a symbol with a setup on both sides counts once
+						industry, _ := getIndustry(symbolMetadata, stock.Symbol)
+						industryGroups[industry].Setups++
+					}
+				}
+
+				result := newScanResult(&stock, &analysis)
+				if *groupOutput {
+					result.Industry, result.Sector = getIndustry(symbolMetadata, stock.Symbol)
+				}
+				if watchlist != nil {
+					watchlist.Record(today, &stock, &result)
+				}
+				if *alignTimeframe != "" {
+					result.HigherTimeframe = *alignTimeframe
+					for _, intersection := range alignedLines {
+						result.AlignedLines = append(result.AlignedLines, newLineResult(&higher, intersection.Type, intersection.Line, intersection.Price))
+					}
+					for _, zone := range alignedZones {
+						result.AlignedZones = append(result.AlignedZones, newZoneResult(&higher, zone))
+					}
+				}
+				if marketRegime != nil {
+					result.Regime = regimeLabel
+					if regimeLabel != UNKNOWN_REGIME {
+						result.RegimeDate = regimeDay.Date.Format(TIME_LAYOUT)
+					}
+				}
+				if screen, ok := screens[stock.Symbol]; ok {
+					for _, ruleResult := range screen.Results {
+						result.Fundamentals = append(result.Fundamentals, newRuleOutput(ruleResult))
+					}
+				}
+				results = append(results, result)
+
+				if *renderCharts {
+					chart := renderChart(&stock, &analysis)
+					chartName := stock.Symbol
+					if side == SHORT_SIDE {
+						chartName += "_short"
+					}
+					chartErr := ioutil.WriteFile(fmt.Sprintf(OUTPUT_CHART_FILE, t.Format("01-02-2006"), chartName), []byte(chart), 0644)
+					if chartErr != nil {
+						fmt.Printf("ERROR writing chart for %s!\n", stock.Symbol)
+					}
+				}
+			}
+		}
+	}
+	if len(tradingCalendar.Holidays) > 0 && !firstBar.IsZero() && !tradingCalendar.Covers(firstBar, lastBar) {
+		fmt.Printf("WARNING: %s covers %d-%d but the bars run from %s to %s, holidays outside it are counted as sessions\n",
+			*holidaysFile, tradingCalendar.FirstYear, tradingCalendar.LastYear, firstBar.Format(TIME_LAYOUT), lastBar.Format(TIME_LAYOUT))
+	}
+
+	if *study {
+		report := fmt.Sprintf("Pivot Detector: %s (ties: %s)\n", *pivotMethod, *pivotTies)
+		if membership != nil {
+			report += getMembershipSummary(membership, studied, studyEvents)
+		}
+		report += getStudyReport(studyEvents, horizons, marketRegime != nil)
+		fmt.Println(report)
+		reportErr := ioutil.WriteFile(fmt.Sprintf(OUTPUT_STUDY_FILE, t.Format("01-02-2006")), []byte(report), 0644)
+		eventsErr := writeStudyEvents(fmt.Sprintf(OUTPUT_STUDY_EVENTS_FILE, t.Format("01-02-2006")), studyEvents, horizons)
+		if reportErr != nil || eventsErr != nil {
+			fmt.Println("ERROR writing to file!")
+		} else {
+			fmt.Println("DONE!")
+		}
+		return
+	}
+
+	// list symbols in rank order
+	rankResults(results)
+	outputSymbols := ""
+	listed := make(map[string]bool)
+	for _, result := range results {
+		if !listed[result.Symbol] {
+			listed[result.Symbol] = true
+			outputSymbols += result.Symbol + "\n"
+		}
+	}
+	fmt.Println(outputSymbols)
+	var output string
+	var templateErr error
+	if *groupOutput {
+		output, templateErr = renderGroupOutput(results, sortIndustryGroups(industryGroups))
+	} else {
+		output, templateErr = renderTextOutput(results)
+	}
+	if templateErr != nil {
+		log.Fatal(templateErr)
+	}
+
+	if len(approaching) > 0 {
+		approachOutput := renderApproachOutput(approaching)
+		output += approachOutput
+		fmt.Print(approachOutput)
+	}
+
+	if marketRegime != nil {
+		fmt.Println("=============== Market Regime ===============")
+		for _, label := range []string{UPTREND, MIXED, DOWNTREND, UNKNOWN_REGIME} {
+			fmt.Printf("%s: %d setups\n", label, setupsByRegime[label])
+		}
+		if *regimeMode == REGIME_SUPPRESS {
+			fmt.Printf("Suppressed in a downtrend: %d setups\n", suppressedByRegime)
+		}
+	}
+
+	if *requireAlign {
+		fmt.Printf("Not aligned with the %s timeframe: %d setups\n", *alignTimeframe, notAligned)
+	}
+
+	if *prefilter {
+		output += "=============== Technical Pre-Filters ===============\n"
+		fmt.Println("=============== Technical Pre-Filters ===============")
+		for _, filter := range technicalFilters {
+			summary := fmt.Sprintf("%s: removed %d symbols", filter.Name, removedByFilter[filter.Name])
+			output += summary + "\n"
+			fmt.Println(summary)
+		}
+	}
+
+	if *minRSRating > 0 {
+		summary := fmt.Sprintf("%s: removed %d symbols", RS_RATING_FILTER, removedByFilter[RS_RATING_FILTER])
+		output += summary + "\n"
+		fmt.Println(summary)
+	}
+
+	if watchlist != nil {
+		diff := watchlist.DiffToString(today)
+		output += "=============== Watchlist ===============\n" + diff
+		fmt.Println("=============== Watchlist ===============")
+		fmt.Print(diff)
+		if err := saveWatchlist(*watchlistFile, watchlist); err != nil {
+			fmt.Println("ERROR writing watchlist!")
+		}
+	}
+
+	if *screenFundamentalsFlag {
+		fmt.Println("=============== Fundamental Screen ===============")
+		fmt.Printf("Screened out: %d symbols\n", numScreenedOut)
+	}
+
+	if *screenFundamentalsFlag || *groupOutput {
+		output += "=============== Portfolio Rules ===============\n"
+		fmt.Println("=============== Portfolio Rules ===============")
+		for _, result := range screenPortfolio(selectedSymbols, fundamentalsSnapshot, symbolMetadata, fundamentalRules) {
+			output += result.ToString() + "\n"
+			fmt.Println(result.ToString())
+		}
+	}
+
+	if *screenFundamentalsFlag {
+		screenErr := ioutil.WriteFile(fmt.Sprintf(OUTPUT_SCREEN_FILE, t.Format("01-02-2006")), []byte(screenOutput), 0644)
+		if screenErr != nil {
+			fmt.Println("ERROR writing screen to file!")
+		}
+	}
+
+	// write to file
+	outputBytes := []byte(output)
+	outputSymbolsBytes := []byte(outputSymbols)
+
+	outputErr := ioutil.WriteFile(fmt.Sprintf(OUTPUT_FILE, t.Format("01-02-2006")), outputBytes, 0644)
+	outputSymbolsErr := ioutil.WriteFile(fmt.Sprintf(OUTPUT_SYMBOLS_FILE, t.Format("01-02-2006")), outputSymbolsBytes, 0644)
+	outputJSONErr := writeJSONLines(fmt.Sprintf(OUTPUT_JSON_FILE, t.Format("01-02-2006")), results)
+	outputCSVErr := writeCSV(fmt.Sprintf(OUTPUT_CSV_FILE, t.Format("01-02-2006")), results)
+	outputApproachErr := writeApproachCSV(fmt.Sprintf(OUTPUT_APPROACH_FILE, t.Format("01-02-2006")), approaching)
+	if outputErr != nil || outputSymbolsErr != nil || outputJSONErr != nil || outputCSVErr != nil || outputApproachErr != nil {
+		fmt.Println("ERROR writing to file!")
+	} else {
+		fmt.Println("DONE!")
+	}
+}
+
+type StockAnalysis struct {
+	Side                      string
+	StartPivots               []Pivot
+	Pivots                    []Pivot
+	TrendChannelLines         []Line
+	TrendLines                []Line
+	HorizontalLines           []Line
+	TrendChannelIntersections []Intersection
+	TrendLineIntersections    []Intersection
+	Setup                     []Intersection
+	Score                     SetupScore
+	Approaches                []Approach
+	Zones                     []Zone
+	Patterns                  []Pattern
+}
+
+// runs pivot and line analysis on one side of the stock. long setups come
+// from low pivots and support, short setups from high pivots and resistance.
+func analyzeStock(stock *StockData, side string) (StockAnalysis, bool) {
+	getHighLines := side == SHORT_SIDE
+	analysis := StockAnalysis{Side: side}
+	analysis.StartPivots = getStartPivots(stock, getHighLines)
+	analysis.Pivots = getPivots(stock, getHighLines, PIVOT_WIDTH)
+	analysis.TrendChannelLines, analysis.TrendLines, analysis.HorizontalLines = getLinesFromPivots(stock, analysis.StartPivots, analysis.Pivots, getHighLines)
+	// a study only measures the setups, so its replayed bars skip zones
+	// unless they are the levels
+	if *levelSource == LEVEL_ZONES {
+		analysis.Zones = getZones(stock)
+		analysis.HorizontalLines = getZoneLines(stock, analysis.Zones)
+	} else if !*study {
+		analysis.Zones = getZones(stock)
+	}
+	analysis.TrendChannelIntersections, analysis.TrendLineIntersections = getAllIntersections(stock, analysis.TrendChannelLines, analysis.TrendLines, getHighLines)
+
+	setup, score, ok := getBestSetup(stock, &analysis)
+	analysis.Setup = setup
+	analysis.Score = score
+	// a study only measures the setups, so its replayed bars skip approaches
+	if !*study {
+		analysis.Approaches = getApproaches(stock, &analysis)
+	}
+	return analysis, ok
+}
+
+func (a *StockAnalysis) GetLevelType() string {
+	if a.Side == SHORT_SIDE {
+		return RESISTANCE
+	}
+	return SUPPORT
+}
+
+func getScanSides(side string) ([]string, error) {
+	switch side {
+	case LONG_SIDE:
+		return []string{LONG_SIDE}, nil
+	case SHORT_SIDE:
+		return []string{SHORT_SIDE}, nil
+	case BOTH_SIDES:
+		return []string{LONG_SIDE, SHORT_SIDE}, nil
+	}
+	return nil, fmt.Errorf("unknown side: %s", side)
+}
+
+// long setups are against a downtrend and short setups against an uptrend
+func isAgainstRegime(side, regimeLabel string) bool {
+	return (side == LONG_SIDE && regimeLabel == DOWNTREND) || (side == SHORT_SIDE && regimeLabel == UPTREND)
+}
+
+func stockDecreased(stock StockData) bool {
+	data := stock.Data
+	return data[len(data)-1].Close < data[len(data)-2].Close
+}
+
+// func getBestSetup(trendChannelLineIntersections, trendLineIntersections, horizontalLineIntersections []Intersection) ([]Intersection, bool) {
+// 	var bestPair []Intersection
+// 	bestRange := math.MaxFloat64
+
+// 	for _, tcl := range trendChannelLineIntersections {
+// 		for _, tl := range trendLineIntersections {
+// 			currRange, currPair := getPairRange(tcl, tl)
+// 			if currRange < bestRange {
+// 				bestRange = currRange
+// 				bestPair = currPair
+// 			}
+// 		}
+// 	}
+
+// 	setup := append(bestPair, horizontalLineIntersections...)
+
+// 	return setup, len(setup)-len(horizontalLineIntersections) >= NUM_INTERSECTIONS_REQUIRED
+// }
+
+// scores every candidate setup and returns the best one. candidates are each
+// trend channel line / trend line pair and, when the last bar is at a
+// horizontal level, each single intersecting line.
+func getBestSetup(stock *StockData, analysis *StockAnalysis) ([]Intersection, SetupScore, bool) {
+	if *brokenToday {
+		return getBestBreak(stock, analysis)
+	}
+
+	// lines the bar gapped through were never in its range
+	var trendChannelIntersections, trendLineIntersections []Intersection
+	for _, intersection := range analysis.TrendChannelIntersections {
+		if intersection.Break != BREAK_GAP_THROUGH {
+			trendChannelIntersections = append(trendChannelIntersections, intersection)
+		}
+	}
+	for _, intersection := range analysis.TrendLineIntersections {
+		if intersection.Break != BREAK_GAP_THROUGH {
+			trendLineIntersections = append(trendLineIntersections, intersection)
+		}
+	}
+
+	var candidates [][]Intersection
+	for _, tcl := range trendChannelIntersections {
+		for _, tl := range trendLineIntersections {
+			_, pair := getPairRange(tcl, tl)
+			candidates = append(candidates, pair)
+		}
+	}
+	if len(analysis.HorizontalLines) > 0 {
+		for _, set := range [][]Intersection{trendChannelIntersections, trendLineIntersections} {
+			for _, intersection := range set {
+				candidates = append(candidates, []Intersection{intersection})
+			}
+		}
+	}
+
+	var bestSetup []Intersection
+	bestScore := SetupScore{Total: -1}
+candidates:
+	for _, candidate := range candidates {
+		for _, intersection := range candidate {
+			if !passesReaction(intersection.Reaction, *reactionFilter) {
+				continue candidates
+			}
+		}
+		score := scoreSetup(stock, analysis, candidate, scoreWeights)
+		if score.Total > bestScore.Total {
+			bestScore = score
+			bestSetup = candidate
+		}
+	}
+
+	return bestSetup, bestScore, len(bestSetup) > 0 && bestScore.Total >= *minScore
+}
+
+// with -breaks the setup is the highest scoring trend line the last bar
+// closed or gapped beyond
+func getBestBreak(stock *StockData, analysis *StockAnalysis) ([]Intersection, SetupScore, bool) {
+	var bestSetup []Intersection
+	bestScore := SetupScore{Total: -1}
+	for _, intersection := range analysis.TrendLineIntersections {
+		if intersection.Break != BREAK_CLOSE && intersection.Break != BREAK_GAP_THROUGH {
+			continue
+		}
+		candidate := []Intersection{intersection}
+		score := scoreSetup(stock, analysis, candidate, scoreWeights)
+		if score.Total > bestScore.Total {
+			bestScore = score
+			bestSetup = candidate
+		}
+	}
+
+	return bestSetup, bestScore, len(bestSetup) > 0 && bestScore.Total >= *minScore
+}
+
+func getPairRange(tclIntersection, tlIntersection Intersection) (float64, []Intersection) {
+	return math.Abs(tclIntersection.Price - tlIntersection.Price), []Intersection{tclIntersection, tlIntersection}
+}
+
+func getAllIntersections(stock *StockData, trendChannelLines, trendLines []Line, getHighLines bool) ([]Intersection, []Intersection) {
+	trendChannelLineIntersections := getIntersections(stock, TREND_CHANNEL_LINE, trendChannelLines, getHighLines)
+	trendLineIntersections := getIntersections(stock, TREND_LINE, trendLines, getHighLines)
+
+	return trendChannelLineIntersections, trendLineIntersections
+}
+
+// func getAllIntersections(stock *StockData, trendChannelLines, trendLines, horizontalLines []Line) ([]Intersection, []Intersection, []Intersection) {
+// 	trendChannelLineIntersections := getIntersections(stock, TREND_CHANNEL_LINE, trendChannelLines)
+// 	trendLineIntersections := getIntersections(stock, TREND_LINE, trendLines)
+// 	horizontalLineIntersections := getIntersections(stock, SUPPORT, horizontalLines)
+
+// 	return trendChannelLineIntersections, trendLineIntersections, horizontalLineIntersections
+// }
+
+func getIntersections(stock *StockData, lineType string, lines []Line, getHighLines bool) []Intersection {
+	var intersections []Intersection
+
+	lastBarIndex := len(stock.Data) - 1
 	for _, line := range lines {
+		price, crosses := line.Crosses(stock.Data[lastBarIndex].Session, stock.Data[lastBarIndex].High, stock.Data[lastBarIndex].Low)
+		breakType := getBreakType(stock, lastBarIndex, price, getHighLines)
+		if crosses || breakType == BREAK_GAP_THROUGH {
+			intersection := Intersection{Line: line, Price: price, Date: stock.Data[lastBarIndex].Date, Type: lineType, Break: breakType}
+			intersection.Reaction, intersection.BarPatterns = getReaction(stock, lastBarIndex, price, getHighLines)
+			intersection.CloseLocation = getCloseLocation(stock.Data[lastBarIndex])
+			intersections = append(intersections, intersection)
+		}
+	}
+
+	return intersections
+}
+
+// Approach is a line the last bar did not reach but the price is near.
+// Distance is the line's price minus the last close, and BarsToContact is
+// estimated from the closing speed between the price and the line over the
+// last -velocity-bars bars, -1 when the price is not moving toward the line.
+type Approach struct {
+	Line            Line
+	Type            string
+	Price           float64
+	Distance        float64
+	DistanceATR     float64
+	DistancePercent float64
+	BarsToContact   float64
+}
+
+// returns the trend lines, trend channel lines and support or resistance
+// levels within -approach-atr ATRs of the last close that the last bar did
+// not cross. levels are taken from every support pivot below the close (or
+// resistance pivot above it), or every such zone with -levels=zones, since
+// the analysis only keeps the levels the last bar reached.
+func getApproaches(stock *StockData, analysis *StockAnalysis) []Approach {
+	data := stock.Data
+	lastBarIndex := len(data) - 1
+	lastBar := data[lastBarIndex]
+	atr := getCurrentATR(stock)
+	if *approachATR <= 0 || atr <= 0 {
+		return nil
+	}
+
+	velocity := 0.0
+	if lookback := *velocityLookback; lookback > 0 && lastBarIndex >= lookback {
+		firstBar := data[lastBarIndex-lookback]
+		velocity = (lastBar.Close - firstBar.Close) / float64(lastBar.Session-firstBar.Session)
+	}
+
+	getHighLines := analysis.Side == SHORT_SIDE
+	var levels []Line
+	if *levelSource == LEVEL_ZONES {
+		for _, zone := range analysis.Zones {
+			levels = append(levels, newZoneLine(stock, zone))
+		}
+	} else {
+		levels = getLevelLines(stock, getHighLines)
+	}
+	var candidates []Line
+	for _, level := range levels {
+		price := level.GetProjection(lastBar.Session)
+		if (!getHighLines && price <= lastBar.Close) || (getHighLines && price >= lastBar.Close) {
+			candidates = append(candidates, level)
+		}
+	}
+
+	var approaches []Approach
+	sets := []struct {
+		Type  string
+		Lines []Line
+	}{{TREND_CHANNEL_LINE, analysis.TrendChannelLines}, {TREND_LINE, analysis.TrendLines}, {analysis.GetLevelType(), candidates}}
+	for _, set := range sets {
+		for _, line := range set.Lines {
+			price, crosses := line.Crosses(lastBar.Session, lastBar.High, lastBar.Low)
+			distance := price - lastBar.Close
+			gapThrough := getBreakType(stock, lastBarIndex, price, analysis.Side == SHORT_SIDE) == BREAK_GAP_THROUGH
+			if crosses || gapThrough || math.Abs(distance) > *approachATR*atr {
+				continue
+			}
+
+			// the gap closes when the price moves toward the line faster
+			// than the line moves away
+			barsToContact := -1.0
+			closingSpeed := velocity - line.PriceSlope(lastBar.Session)
+			if distance*closingSpeed > 0 {
+				barsToContact = distance / closingSpeed
+			}
+			approaches = append(approaches, Approach{line, set.Type, price, distance, distance / atr, distance / lastBar.Close, barsToContact})
+		}
+	}
+
+	return approaches
+}
+
+// classifies the bar at index against a line at price, where beyond means
+// below lines drawn through lows and above lines drawn through highs:
+//   - gap-through: the previous close was not beyond the line but the bar
+//     opened more than BREAK_ATR_MULTIPLE ATRs beyond it and closed beyond
+//   - break: the close is more than BREAK_ATR_MULTIPLE ATRs beyond the line
+//   - failed break: the bar pierced that far beyond but closed back
+//   - touch: anything else
+func getBreakType(stock *StockData, index int, price float64, getHighLines bool) string {
+	threshold := math.Max(0, BREAK_ATR_MULTIPLE*stock.Data[index].ATR)
+	beyond := func(value float64) float64 {
+		if getHighLines {
+			return value - price
+		}
+		return price - value
+	}
+
+	bar := stock.Data[index]
+	extreme := bar.Low
+	if getHighLines {
+		extreme = bar.High
+	}
+	switch {
+	case index > 0 && beyond(stock.Data[index-1].Close) <= 0 && beyond(bar.Open) > threshold && beyond(bar.Close) > 0:
+		return BREAK_GAP_THROUGH
+	case beyond(bar.Close) > threshold:
+		return BREAK_CLOSE
+	case beyond(extreme) > threshold && beyond(bar.Close) <= 0:
+		return BREAK_FAILED
+	}
+	return BREAK_TOUCH
+}
+
+// returns the bar patterns formed by the bar at index and the bar before it
+func getBarPatterns(stock *StockData, index int) []string {
+	var patterns []string
+	bar := stock.Data[index]
+	body := math.Abs(bar.Close - bar.Open)
+	barRange := bar.High - bar.Low
+	upperWick := bar.High - math.Max(bar.Open, bar.Close)
+	lowerWick := math.Min(bar.Open, bar.Close) - bar.Low
+
+	if barRange > 0 {
+		if lowerWick >= PIN_WICK_RATIO*body && lowerWick >= PIN_WICK_FRACTION*barRange {
+			patterns = append(patterns, HAMMER)
+		}
+		if upperWick >= PIN_WICK_RATIO*body && upperWick >= PIN_WICK_FRACTION*barRange {
+			patterns = append(patterns, SHOOTING_STAR)
+		}
+	}
+	if index == 0 {
+		return patterns
+	}
+
+	prev := stock.Data[index-1]
+	if prev.Close < prev.Open && bar.Close > bar.Open && bar.Open <= prev.Close && bar.Close >= prev.Open {
+		patterns = append(patterns, BULLISH_ENGULFING)
+	}
+	if prev.Close > prev.Open && bar.Close < bar.Open && bar.Open >= prev.Close && bar.Close <= prev.Open {
+		patterns = append(patterns, BEARISH_ENGULFING)
+	}
+	if bar.High <= prev.High && bar.Low >= prev.Low {
+		patterns = append(patterns, INSIDE_BAR)
+	}
+	if bar.High > prev.High && bar.Low < prev.Low {
+		patterns = append(patterns, OUTSIDE_BAR)
+		if bar.Close > prev.High {
+			patterns = append(patterns, BULLISH_OUTSIDE_REVERSAL)
+		} else if bar.Close < prev.Low {
+			patterns = append(patterns, BEARISH_OUTSIDE_REVERSAL)
+		}
+	}
+	return patterns
+}
+
+// classifies how the bar at index reacted to a line at price. lines drawn
+// through lows should hold below the close and lines through highs above it.
+func getReaction(stock *StockData, index int, price float64, getHighLines bool) (string, []string) {
+	patterns := getBarPatterns(stock, index)
+	bar := stock.Data[index]
+	if (!getHighLines && bar.Close < price) || (getHighLines && bar.Close > price) {
+		return REACTION_THROUGH, patterns
+	}
+
+	reversals := []string{HAMMER, BULLISH_ENGULFING, BULLISH_OUTSIDE_REVERSAL}
+	if getHighLines {
+		reversals = []string{SHOOTING_STAR, BEARISH_ENGULFING, BEARISH_OUTSIDE_REVERSAL}
+	}
+	for _, pattern := range patterns {
+		for _, reversal := range reversals {
+			if pattern == reversal {
+				return REACTION_REVERSAL, patterns
+			}
+		}
+	}
+	return REACTION_HOLD, patterns
+}
+
+// reports whether a reaction satisfies the -reaction filter. hold accepts
+// reversals as well.
+func passesReaction(reaction, filter string) bool {
+	switch filter {
+	case REACTION_REVERSAL:
+		return reaction == REACTION_REVERSAL
+	case REACTION_HOLD:
+		return reaction == REACTION_REVERSAL || reaction == REACTION_HOLD
+	}
+	return true
+}
+
+// draw lines for low pivots:
+// iteratively go through pivots
+// have an anchor pivot (use start pivots as anchor pivots)
+// create a line if a next pivot creates a line with a slope less than what's been seen so far
+
+// returns trendLines, trendChannelLines, horizontalLines
+func getLines(stock *StockData, getOverLines bool) ([]Line, []Line, []Line) {
+	startPivots := getStartPivots(stock, getOverLines)
+	endPivots := getPivots(stock, getOverLines, PIVOT_WIDTH)
+	return getLinesFromPivots(stock, startPivots, endPivots, getOverLines)
+}
+
+func getLinesFromPivots(stock *StockData, startPivots []Pivot, pivots []Pivot, getHighLines bool) ([]Line, []Line, []Line) {
+	var lines []Line
+	currentPivotIndex := 0
+
+	for _, startPivot := range startPivots {
+		var prevLine interface{}
+		prevLine = nil
+		for j := currentPivotIndex; j < len(pivots); j++ {
+			pivot := pivots[j]
+			if pivot.Index > startPivot.Index {
+				if pivots[currentPivotIndex].Index <= startPivot.Index {
+					currentPivotIndex = j
+				}
+
+				// interface conversion
+				var prevLineConverted Line
+				if prevLine != nil {
+					prevLineConverted = prevLine.(Line)
+				}
+
+				// draw lines
+				if getHighLines {
+					currLine := newLineFromPivots(stock, startPivot, stock.Data[startPivot.Index].High, pivot, stock.Data[pivot.Index].High)
+					if currLine.FitsPivots(stock, pivots[j:], getHighLines) && (prevLine == nil || currLine.Slope() >= prevLineConverted.Slope()) {
+						currLine.Violations = currLine.CountViolations(stock, pivots[j:], getHighLines)
+						prevLine = currLine
+						lines = append(lines, currLine)
+					}
+				} else {
+					currLine := newLineFromPivots(stock, startPivot, stock.Data[startPivot.Index].Low, pivot, stock.Data[pivot.Index].Low)
+					if currLine.FitsPivots(stock, pivots[j:], getHighLines) && (prevLine == nil || currLine.Slope() <= prevLineConverted.Slope()) {
+						currLine.Violations = currLine.CountViolations(stock, pivots[j:], getHighLines)
+						prevLine = currLine
+						lines = append(lines, currLine)
+					}
+				}
+			}
+		}
+	}
+
+	// record how often each line is touched by all pivots after its start.
+	// violations were counted over the pivots the line was fitted to.
+	touchPivots := append(append([]Pivot{}, startPivots...), pivots...)
+	for i := range lines {
+		lines[i].Touches, lines[i].LastTouch = countTouches(stock, &lines[i], touchPivots, getHighLines)
+	}
+
+	var trendLines []Line
+	var trendChannelLines []Line
+	var horizontalLines []Line
+
+	if getHighLines {
+		horizontalLines = getResistance(stock)
+	} else {
+		horizontalLines = getSupport(stock)
+	}
+
+	for _, line := range lines {
+		if getHighLines {
+			if line.Slope() > 0 { //HORIZONTAL_SLOPE_THRESHOLD {
+				trendChannelLines = append(trendChannelLines, line)
+			} else { //if line.Slope() < -HORIZONTAL_SLOPE_THRESHOLD {
+				trendLines = append(trendLines, line)
+			}
+			// else {
+			// 	horizontalLines = append(horizontalLines, line)
+			// }
+		} else {
+			if line.Slope() >= 0 { // HORIZONTAL_SLOPE_THRESHOLD {
+				trendLines = append(trendLines, line)
+			} else { // } if line.Slope() < 0 { //-HORIZONTAL_SLOPE_THRESHOLD {
+				trendChannelLines = append(trendChannelLines, line)
+			}
+			// else {
+			// 	horizontalLines = append(horizontalLines, line)
+			// }
+		}
+	}
+
+	return trendChannelLines, trendLines, horizontalLines
+}
+
+func getSupport(stock *StockData) []Line {
+	var support []Line
+	pivots := getPivots(stock, false, SUPPORT_PIVOT_WIDTH)
+	for _, pivot := range pivots {
+		supportLow := stock.Data[pivot.Index].Low
+		currentIndex := len(stock.Data) - 1
+		currentHigh := stock.Data[currentIndex].High
+		currentLow := stock.Data[currentIndex].Low
+		if supportLow > currentLow*(1-SUPPORT_RANGE_PERCENT) && supportLow < currentHigh*(1+SUPPORT_RANGE_PERCENT) {
+			line := newLineFromPivots(stock, pivot, supportLow, Pivot{currentIndex, currentIndex, false, 1.0}, supportLow)
+			line.Touches, line.LastTouch = countTouches(stock, &line, pivots, false)
+			support = append(support, line)
+		}
+	}
+	return support
+}
+
+// returns a horizontal line at every confirmed SUPPORT_PIVOT_WIDTH pivot low
+// (or high), drawn to the last bar, whether or not the last bar reached it
+func getLevelLines(stock *StockData, getHighLines bool) []Line {
+	var levels []Line
+	pivots := getPivots(stock, getHighLines, SUPPORT_PIVOT_WIDTH)
+	currentIndex := len(stock.Data) - 1
+	for _, pivot := range pivots {
+		price := stock.Data[pivot.Index].Low
+		if getHighLines {
+			price = stock.Data[pivot.Index].High
+		}
+		line := newLineFromPivots(stock, pivot, price, Pivot{currentIndex, currentIndex, false, 1.0}, price)
+		line.Touches, line.LastTouch = countTouches(stock, &line, pivots, getHighLines)
+		levels = append(levels, line)
+	}
+	return levels
+}
+
+func getResistance(stock *StockData) []Line {
+	var resistance []Line
+	pivots := getPivots(stock, true, SUPPORT_PIVOT_WIDTH)
+	for _, pivot := range pivots {
+		resistanceHigh := stock.Data[pivot.Index].High
+		currentIndex := len(stock.Data) - 1
+		currentHigh := stock.Data[currentIndex].High
+		currentLow := stock.Data[currentIndex].Low
+		if resistanceHigh > currentLow*(1-SUPPORT_RANGE_PERCENT) && resistanceHigh < currentHigh*(1+SUPPORT_RANGE_PERCENT) {
+			line := newLineFromPivots(stock, pivot, resistanceHigh, Pivot{currentIndex, currentIndex, false, 1.0}, resistanceHigh)
+			line.Touches, line.LastTouch = countTouches(stock, &line, pivots, true)
+			resistance = append(resistance, line)
+		}
+	}
+	return resistance
+}
+
+// Zone is a price band where pivot highs and lows cluster. its role is
+// relative to the last close: support below, resistance above, or inside when
+// the close is within the band. a reversal zone is support that used to cap
+// the price (pivot highs) or resistance that used to hold it (pivot lows).
+type Zone struct {
+	Low         float64
+	High        float64
+	Touches     int
+	LowTouches  int
+	HighTouches int
+	FirstTouch  int
+	LastTouch   int
+	Volume      float64
+	Strength    float64
+	Role        string
+	Reversal    bool
+}
+
+func (z *Zone) Center() float64 {
+	return (z.Low + z.High) / 2
+}
+
+// clusters the confirmed ZONE_PIVOT_WIDTH pivot highs and lows whose prices
+// lie within -zone-atr ATRs of the lowest price in the cluster. strength is
+// the average of the capped touch count, the touch bars' volume relative to
+// the average volume, and how recently the zone was touched.
+func getZones(stock *StockData) []Zone {
+	data := stock.Data
+	lastBarIndex := len(data) - 1
+	atr := getCurrentATR(stock)
+	if atr <= 0 {
+		return nil
+	}
+
+	type touch struct {
+		Index int
+		Price float64
+		High  bool
+	}
+	var touches []touch
+	for _, pivot := range getPivots(stock, false, ZONE_PIVOT_WIDTH) {
+		touches = append(touches, touch{pivot.Index, data[pivot.Index].Low, false})
+	}
+	for _, pivot := range getPivots(stock, true, ZONE_PIVOT_WIDTH) {
+		touches = append(touches, touch{pivot.Index, data[pivot.Index].High, true})
+	}
+	sort.Slice(touches, func(i, j int) bool {
+		return touches[i].Price < touches[j].Price
+	})
+
+	averageVolume := getAverageVolume(stock, len(data))
+	lastClose := data[lastBarIndex].Close
+	var zones []Zone
+	for start := 0; start < len(touches); {
+		end := start
+		for end < len(touches) && touches[end].Price-touches[start].Price <= *zoneATR*atr {
+			end++
+		}
+
+		zone := Zone{Low: touches[start].Price, High: touches[end-1].Price, FirstTouch: lastBarIndex, LastTouch: 0}
+		volume := 0.0
+		for _, t := range touches[start:end] {
+			zone.Touches++
+			if t.High {
+				zone.HighTouches++
+			} else {
+				zone.LowTouches++
+			}
+			if t.Index < zone.FirstTouch {
+				zone.FirstTouch = t.Index
+			}
+			if t.Index > zone.LastTouch {
+				zone.LastTouch = t.Index
+			}
+			volume += float64(data[t.Index].Volume)
+		}
+		if averageVolume > 0 {
+			zone.Volume = volume / float64(zone.Touches) / averageVolume
+		}
+
+		touchScore := math.Min(float64(zone.Touches), float64(MAX_TOUCHES)) / float64(MAX_TOUCHES)
+		volumeScore := math.Min(zone.Volume, MAX_VOLUME_RATIO) / MAX_VOLUME_RATIO
+		recencyScore := 1 - float64(lastBarIndex-zone.LastTouch)/float64(len(data))
+		zone.Strength = (touchScore + volumeScore + recencyScore) / 3 * 100
+
+		if lastClose > zone.High {
+			zone.Role = SUPPORT
+			zone.Reversal = zone.HighTouches > 0
+		} else if lastClose < zone.Low {
+			zone.Role = RESISTANCE
+			zone.Reversal = zone.LowTouches > 0
+		} else {
+			zone.Role = INSIDE_ZONE
+		}
+
+		zones = append(zones, zone)
+		start = end
+	}
+
+	return zones
+}
+
+// returns the indices of the nearest zone entirely below and entirely above
+// the price, -1 when there is none
+func getNearestZones(zones []Zone, price float64) (int, int) {
+	below, above := -1, -1
+	for i, zone := range zones {
+		if zone.High < price && (below < 0 || zone.High > zones[below].High) {
+			below = i
+		}
+		if zone.Low > price && (above < 0 || zone.Low < zones[above].Low) {
+			above = i
+		}
+	}
+	return below, above
+}
+
+// returns a horizontal line at the center of each zone the last bar reached,
+// drawn from the zone's first touch
+func getZoneLines(stock *StockData, zones []Zone) []Line {
+	var lines []Line
+	currentIndex := len(stock.Data) - 1
+	currentBar := stock.Data[currentIndex]
+	for _, zone := range zones {
+		if zone.Low > currentBar.High || zone.High < currentBar.Low {
+			continue
+		}
+		lines = append(lines, newZoneLine(stock, zone))
+	}
+	return lines
+}
+
+func newZoneLine(stock *StockData, zone Zone) Line {
+	currentIndex := len(stock.Data) - 1
+	center := zone.Center()
+	line := newLineFromPivots(stock, Pivot{zone.FirstTouch, zone.FirstTouch, false, 1.0}, center, Pivot{currentIndex, currentIndex, false, 1.0}, center)
+	line.Touches, line.LastTouch = zone.Touches, zone.LastTouch
+	return line
+}
+
+// Pattern is a named price-action pattern formed by the pivots at Pivots.
+// Target is the measured-move price objective and the pattern is invalidated
+// if the price moves beyond Invalidation.
+type Pattern struct {
+	Name         string
+	Direction    string
+	Pivots       []int
+	Target       float64
+	Invalidation float64
+}
+
+// recognizes chart patterns in the pivots and lines of the last
+// PATTERN_LOOKBACK bars, taken from the analyses of the pivot lows and the
+// pivot highs. patterns the last close has already invalidated are dropped.
+func getPatterns(stock *StockData, lowAnalysis, highAnalysis *StockAnalysis) []Pattern {
+	data := stock.Data
+	lastBarIndex := len(data) - 1
+	atr := getCurrentATR(stock)
+	if atr <= 0 {
+		return nil
+	}
+
+	recent := func(pivots []Pivot) []int {
+		var indices []int
+		for _, pivot := range pivots {
+			if pivot.Index >= lastBarIndex-PATTERN_LOOKBACK {
+				indices = append(indices, pivot.Index)
+			}
+		}
+		return indices
+	}
+	lows := recent(lowAnalysis.Pivots)
+	highs := recent(highAnalysis.Pivots)
+
+	// the latest line through recent pivots bounds the price on each side
+	latest := func(analysis *StockAnalysis) (Line, bool) {
+		var latest Line
+		found := false
+		for _, line := range append(analysis.TrendLines, analysis.TrendChannelLines...) {
+			if line.X1 < lastBarIndex-PATTERN_LOOKBACK {
+				continue
+			}
+			if !found || line.X2 > latest.X2 || (line.X2 == latest.X2 && line.X1 < latest.X1) {
+				latest, found = line, true
+			}
+		}
+		return latest, found
+	}
+
+	var patterns []Pattern
+	patterns = append(patterns, getDoublePatterns(stock, lows, highs, atr)...)
+	patterns = append(patterns, getTrendStructure(stock, lows, highs)...)
+	if lower, ok := latest(lowAnalysis); ok {
+		if upper, ok := latest(highAnalysis); ok {
+			patterns = append(patterns, getConvergingPatterns(stock, lower, upper, atr)...)
+		}
+	}
+	patterns = append(patterns, getRangeBreakouts(stock, atr)...)
+
+	var valid []Pattern
+	lastClose := data[lastBarIndex].Close
+	for _, pattern := range patterns {
+		if (pattern.Direction == BULLISH && lastClose >= pattern.Invalidation) || (pattern.Direction == BEARISH && lastClose <= pattern.Invalidation) {
+			valid = append(valid, pattern)
+		}
+	}
+	return valid
+}
+
+// long setups report the bullish patterns and short setups the bearish ones
+func getSidePatterns(patterns []Pattern, side string) []Pattern {
+	direction := BULLISH
+	if side == SHORT_SIDE {
+		direction = BEARISH
+	}
+	var sidePatterns []Pattern
+	for _, pattern := range patterns {
+		if pattern.Direction == direction {
+			sidePatterns = append(sidePatterns, pattern)
+		}
+	}
+	return sidePatterns
+}
+
+// double bottoms are the last two pivot lows within DOUBLE_ATR_MULTIPLE ATRs
+// of each other with a peak at least DOUBLE_MIN_DEPTH_ATR ATRs above them in
+// between. the peak is the neckline and the target is the pattern's height
+// above it. double tops are the mirror image.
+func getDoublePatterns(stock *StockData, lows, highs []int, atr float64) []Pattern {
+	data := stock.Data
+	var patterns []Pattern
+
+	if len(lows) >= 2 {
+		first, second := lows[len(lows)-2], lows[len(lows)-1]
+		neck := first
+		for i := first; i <= second; i++ {
+			if data[i].High > data[neck].High {
+				neck = i
+			}
+		}
+		bottom := math.Min(data[first].Low, data[second].Low)
+		neckline := data[neck].High
+		if math.Abs(data[first].Low-data[second].Low) <= DOUBLE_ATR_MULTIPLE*atr && neckline-math.Max(data[first].Low, data[second].Low) >= DOUBLE_MIN_DEPTH_ATR*atr {
+			patterns = append(patterns, Pattern{DOUBLE_BOTTOM, BULLISH, []int{first, neck, second}, neckline + (neckline - bottom), bottom})
+		}
+	}
+
+	if len(highs) >= 2 {
+		first, second := highs[len(highs)-2], highs[len(highs)-1]
+		neck := first
+		for i := first; i <= second; i++ {
+			if data[i].Low < data[neck].Low {
+				neck = i
+			}
+		}
+		top := math.Max(data[first].High, data[second].High)
+		neckline := data[neck].Low
+		if math.Abs(data[first].High-data[second].High) <= DOUBLE_ATR_MULTIPLE*atr && math.Min(data[first].High, data[second].High)-neckline >= DOUBLE_MIN_DEPTH_ATR*atr {
+			patterns = append(patterns, Pattern{DOUBLE_TOP, BEARISH, []int{first, neck, second}, neckline - (top - neckline), top})
+		}
+	}
+
+	return patterns
+}
+
+// an uptrend structure is two rising pivot highs and two rising pivot lows.
+// the target repeats the last swing up from the latest low, which is also the
+// invalidation level. downtrends are the mirror image.
+func getTrendStructure(stock *StockData, lows, highs []int) []Pattern {
+	data := stock.Data
+	if len(lows) < 2 || len(highs) < 2 {
+		return nil
+	}
+
+	prevLow, lastLow := lows[len(lows)-2], lows[len(lows)-1]
+	prevHigh, lastHigh := highs[len(highs)-2], highs[len(highs)-1]
+	pivots := []int{prevLow, prevHigh, lastLow, lastHigh}
+	sort.Ints(pivots)
+
+	if data[lastLow].Low > data[prevLow].Low && data[lastHigh].High > data[prevHigh].High {
+		swing := data[lastHigh].High - data[prevLow].Low
+		return []Pattern{{HIGHER_HIGHS_LOWS, BULLISH, pivots, data[lastLow].Low + swing, data[lastLow].Low}}
+	}
+	if data[lastLow].Low < data[prevLow].Low && data[lastHigh].High < data[prevHigh].High {
+		swing := data[prevHigh].High - data[lastLow].Low
+		return []Pattern{{LOWER_HIGHS_LOWS, BEARISH, pivots, data[lastHigh].High - swing, data[lastHigh].High}}
+	}
+	return nil
+}
+
+// classifies the upper line through pivot highs and the lower line through
+// pivot lows by their slopes in ATRs per bar, flat within
+// FLAT_SLOPE_ATR_PER_BAR. parallel lines after a pole of
+// FLAG_POLE_ATR ATRs are flags, converging lines are triangles or wedges. the
+// target is the pattern's height (or the pole for flags) beyond the line it
+// breaks and the opposite line is the invalidation level.
+func getConvergingPatterns(stock *StockData, lower, upper Line, atr float64) []Pattern {
+	data := stock.Data
+	lastBar := data[len(data)-1]
+	start := upper.X1
+	if lower.X1 < start {
+		start = lower.X1
+	}
+	upperSlope := upper.PriceSlope(lastBar.Session) / atr
+	lowerSlope := lower.PriceSlope(lastBar.Session) / atr
+	upperPrice, lowerPrice := upper.GetProjection(lastBar.Session), lower.GetProjection(lastBar.Session)
+	height := upper.GetProjection(data[start].Session) - lower.GetProjection(data[start].Session)
+	if height <= 0 || upperPrice <= lowerPrice {
+		return nil
+	}
+	converging := upperPrice-lowerPrice < height
+	pivots := []int{upper.X1, upper.X2, lower.X1, lower.X2}
+	sort.Ints(pivots)
+
+	bullish := func(name string, move float64) []Pattern {
+		return []Pattern{{name, BULLISH, pivots, upperPrice + move, lowerPrice}}
+	}
+	bearish := func(name string, move float64) []Pattern {
+		return []Pattern{{name, BEARISH, pivots, lowerPrice - move, upperPrice}}
+	}
+
+	flat := func(slope float64) bool {
+		return math.Abs(slope) <= FLAT_SLOPE_ATR_PER_BAR
+	}
+	if start >= FLAG_POLE_BARS && flat(upperSlope-lowerSlope) {
+		pole := data[start].Close - data[start-FLAG_POLE_BARS].Close
+		if pole >= FLAG_POLE_ATR*atr && upperSlope <= FLAT_SLOPE_ATR_PER_BAR {
+			return bullish(BULL_FLAG, pole)
+		}
+		if pole <= -FLAG_POLE_ATR*atr && lowerSlope >= -FLAT_SLOPE_ATR_PER_BAR {
+			return bearish(BEAR_FLAG, -pole)
+		}
+	}
+	if !converging {
+		return nil
+	}
+
+	switch {
+	case flat(upperSlope) && lowerSlope > FLAT_SLOPE_ATR_PER_BAR:
+		return bullish(ASCENDING_TRIANGLE, height)
+	case upperSlope < -FLAT_SLOPE_ATR_PER_BAR && flat(lowerSlope):
+		return bearish(DESCENDING_TRIANGLE, height)
+	case upperSlope < -FLAT_SLOPE_ATR_PER_BAR && lowerSlope > FLAT_SLOPE_ATR_PER_BAR:
+		// the direction is set by the break, targets assume the prevailing trend
+		if data[start].Close >= data[int(math.Max(0, float64(start-PATTERN_LOOKBACK)))].Close {
+			return bullish(SYMMETRICAL_TRIANGLE, height)
+		}
+		return bearish(SYMMETRICAL_TRIANGLE, height)
+	case upperSlope > FLAT_SLOPE_ATR_PER_BAR && lowerSlope > FLAT_SLOPE_ATR_PER_BAR:
+		return bearish(RISING_WEDGE, height)
+	case upperSlope < -FLAT_SLOPE_ATR_PER_BAR && lowerSlope < -FLAT_SLOPE_ATR_PER_BAR:
+		return bullish(FALLING_WEDGE, height)
+	}
+	return nil
+}
+
+// a range is the RANGE_BARS bars before the last one when their high and low
+// are within MAX_RANGE_ATR ATRs. a close beyond the range is a breakout (or
+// breakdown) targeting the range's height beyond it, invalidated by a move
+// back through the other side.
+func getRangeBreakouts(stock *StockData, atr float64) []Pattern {
+	data := stock.Data
+	lastBarIndex := len(data) - 1
+	if lastBarIndex < RANGE_BARS {
+		return nil
+	}
+
+	highIndex, lowIndex := lastBarIndex-RANGE_BARS, lastBarIndex-RANGE_BARS
+	for i := lastBarIndex - RANGE_BARS; i < lastBarIndex; i++ {
+		if data[i].High > data[highIndex].High {
+			highIndex = i
+		}
+		if data[i].Low < data[lowIndex].Low {
+			lowIndex = i
+		}
+	}
+	rangeHigh, rangeLow := data[highIndex].High, data[lowIndex].Low
+	height := rangeHigh - rangeLow
+	if height > MAX_RANGE_ATR*atr {
+		return nil
+	}
+
+	pivots := []int{highIndex, lowIndex}
+	sort.Ints(pivots)
+	lastClose := data[lastBarIndex].Close
+	if lastClose > rangeHigh {
+		return []Pattern{{RANGE_BREAKOUT, BULLISH, pivots, rangeHigh + height, rangeLow}}
+	}
+	if lastClose < rangeLow {
+		return []Pattern{{RANGE_BREAKDOWN, BEARISH, pivots, rangeLow - height, rangeHigh}}
+	}
+	return nil
+}
+
+func getStartPivots(stock *StockData, getHighPivots bool) []Pivot {
+	return getPivots(stock, getHighPivots, START_PIVOT_WIDTH)
+}
+
+// returns the pivots of the selected detector. a replayed history gets the
+// cached pivots whose Confirmed bar it has reached.
+func getPivots(stock *StockData, getHighPivots bool, width int) []Pivot {
+	cache := stock.PivotCache
+	if cache == nil || *provisionalPivots {
+		return pivotDetector.GetPivots(stock, getHighPivots, width)
+	}
+
+	key := PivotKey{getHighPivots, width}
+	pivots, ok := cache.Pivots[key]
+	if !ok {
+		pivots = pivotDetector.GetPivots(cache.Stock, getHighPivots, width)
+		cache.Pivots[key] = pivots
+	}
+	var confirmed []Pivot
+	for _, pivot := range pivots {
+		if pivot.Confirmed <= len(stock.Data)-1 {
+			confirmed = append(confirmed, pivot)
+		}
+	}
+	return confirmed
+}
+
+// PivotDetector finds swing lows (or highs) in a stock's bars. width is the
+// detector's sensitivity: larger widths yield fewer, more significant pivots,
+// with PIVOT_WIDTH as the reference for detectors that are not window based.
+type PivotDetector interface {
+	GetPivots(stock *StockData, getHighPivots bool, width int) []Pivot
+}
+
+// WindowPivotDetector marks bars that are the lowest low (or highest high)
+// within width bars on both sides. a pivot is confirmed width bars after it
+// forms. with -provisional, extremes among the last width bars that have at
+// least PROVISIONAL_MIN_BARS bars on their right are returned as provisional.
+type WindowPivotDetector struct {
+	Ties string
+}
+
+// ZigZagPivotDetector marks the extreme of each swing once price reverses
+// from it by ZIGZAG_ATR_MULTIPLE ATRs (scaled by width / PIVOT_WIDTH). the
+// pivot is confirmed on the bar that completes the reversal.
+type ZigZagPivotDetector struct {
+	Ties string
+}
+
+// PercentPivotDetector is the zigzag with a reversal of PERCENT_REVERSAL of the
+// extreme's price (scaled by width / PIVOT_WIDTH) instead of ATRs.
+type PercentPivotDetector struct {
+	Ties string
+}
+
+// FractalPivotDetector marks Williams fractals: bars with FRACTAL_WIDTH bars on
+// each side that do not reach past them. for widths above FRACTAL_WIDTH the
+// fractal must also be the extreme of the preceding width bars, so pivots are
+// still confirmed FRACTAL_WIDTH bars after they form. with -provisional,
+// fractals with at least one bar on their right are returned as provisional.
+type FractalPivotDetector struct {
+	Ties string
+}
+
+func (d WindowPivotDetector) GetPivots(stock *StockData, getHighPivots bool, width int) []Pivot {
+	var pivots []Pivot
+	data := stock.Data
+
+	firstProvisional := len(data) - width
+	lastPivot := len(data) - width - 1
+	if *provisionalPivots {
+		lastPivot = len(data) - 1 - PROVISIONAL_MIN_BARS
+	}
+
+	for i := width; i <= lastPivot; i++ {
+		if isWindowExtreme(data, i, i-width, i+width, getHighPivots, d.Ties) {
+			if i >= firstProvisional {
+				rightBars := len(data) - 1 - i
+				pivots = append(pivots, Pivot{i, len(data) - 1, true, float64(rightBars) / float64(width)})
+			} else {
+				pivots = append(pivots, Pivot{i, i + width, false, 1.0})
+			}
+		}
+	}
+
+	return pivots
+}
+
+func (d ZigZagPivotDetector) GetPivots(stock *StockData, getHighPivots bool, width int) []Pivot {
+	scale := float64(width) / float64(PIVOT_WIDTH)
+	return getSwingPivots(stock, getHighPivots, d.Ties, func(i int, extreme float64) float64 {
+		// before the ATR window fills, fall back on the bars seen so far so
+		// that a pivot does not depend on later bars
+		atr := stock.Data[i].ATR
+		if atr <= 0 {
+			atr = getCurrentATR(&StockData{Data: stock.Data[:i+1]})
+		}
+		return ZIGZAG_ATR_MULTIPLE * scale * atr
+	})
+}
+
+func (d PercentPivotDetector) GetPivots(stock *StockData, getHighPivots bool, width int) []Pivot {
+	scale := float64(width) / float64(PIVOT_WIDTH)
+	return getSwingPivots(stock, getHighPivots, d.Ties, func(i int, extreme float64) float64 {
+		return PERCENT_REVERSAL * scale * extreme
+	})
+}
+
+func (d FractalPivotDetector) GetPivots(stock *StockData, getHighPivots bool, width int) []Pivot {
+	var pivots []Pivot
+	data := stock.Data
+
+	firstProvisional := len(data) - FRACTAL_WIDTH
+	lastPivot := len(data) - FRACTAL_WIDTH - 1
+	if *provisionalPivots {
+		lastPivot = len(data) - 2
+	}
+
+	for i := FRACTAL_WIDTH; i <= lastPivot; i++ {
+		if !isWindowExtreme(data, i, i-FRACTAL_WIDTH, i+FRACTAL_WIDTH, getHighPivots, d.Ties) {
+			continue
+		}
+		if width > FRACTAL_WIDTH && (i < width || !isWindowExtreme(data, i, i-width, i, getHighPivots, d.Ties)) {
+			continue
+		}
+		if i >= firstProvisional {
+			rightBars := len(data) - 1 - i
+			pivots = append(pivots, Pivot{i, len(data) - 1, true, float64(rightBars) / float64(FRACTAL_WIDTH)})
+		} else {
+			pivots = append(pivots, Pivot{i, i + FRACTAL_WIDTH, false, 1.0})
+		}
+	}
+
+	return pivots
+}
+
+// reports whether bar i is the lowest low (or highest high) of the bars from
+// start to end. ties decides which of several equal extremes qualify: all of
+// them, only the first or only the last.
+func isWindowExtreme(data []StockBar, i, start, end int, getHighPivots bool, ties string) bool {
+	price := func(j int) float64 {
+		if getHighPivots {
+			return data[j].High
+		}
+		return -data[j].Low
+	}
+
+	for j := start; j <= end && j < len(data); j++ {
+		if j < 0 || j == i {
+			continue
+		}
+		if price(j) > price(i) {
+			return false
+		}
+		if price(j) == price(i) && ((ties == TIES_FIRST && j < i) || (ties == TIES_LAST && j > i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// walks the bars as alternating swings. the extreme of the current swing
+// becomes a pivot once price moves reversal(i, extreme) away from it in the
+// other direction. with -provisional, the extreme of the unfinished swing is
+// returned as a provisional pivot with a confidence of how far the reversal
+// has come.
+func getSwingPivots(stock *StockData, getHighPivots bool, ties string, reversal func(i int, extreme float64) float64) []Pivot {
+	var pivots []Pivot
+	data := stock.Data
+	if len(data) == 0 {
+		return pivots
+	}
+
+	// later equal extremes only replace the current one when keeping the last
+	beyond := func(price, extreme float64) bool {
+		return price > extreme || (ties == TIES_LAST && price == extreme)
+	}
+
+	// with ties=all, the equal extremes of a swing are pivots along with the
+	// first one
+	addPivot := func(pivot Pivot, end int) {
+		pivots = append(pivots, pivot)
+		if ties != TIES_ALL {
+			return
+		}
+		extreme := pivot.Index
+		for j := extreme + 1; j < end; j++ {
+			if (getHighPivots && data[j].High == data[extreme].High) || (!getHighPivots && data[j].Low == data[extreme].Low) {
+				pivot.Index = j
+				pivots = append(pivots, pivot)
+			}
+		}
+	}
+
+	direction := 0
+	highIndex, lowIndex := 0, 0
+	for i := 1; i < len(data); i++ {
+		if direction >= 0 && beyond(data[i].High, data[highIndex].High) {
+			highIndex = i
+		}
+		if direction <= 0 && beyond(-data[i].Low, -data[lowIndex].Low) {
+			lowIndex = i
+		}
+
+		if direction >= 0 && highIndex < i && data[highIndex].High-data[i].Low >= reversal(i, data[highIndex].High) {
+			if getHighPivots {
+				addPivot(Pivot{highIndex, i, false, 1.0}, i)
+			}
+			direction = -1
+			lowIndex = i
+		} else if direction <= 0 && lowIndex < i && data[i].High-data[lowIndex].Low >= reversal(i, data[lowIndex].Low) {
+			if !getHighPivots {
+				addPivot(Pivot{lowIndex, i, false, 1.0}, i)
+			}
+			direction = 1
+			highIndex = i
+		}
+	}
+
+	if *provisionalPivots {
+		lastBarIndex := len(data) - 1
+		if getHighPivots && direction > 0 && lastBarIndex-highIndex >= PROVISIONAL_MIN_BARS {
+			move := data[highIndex].High - getLowestLow(data[highIndex:])
+			confidence := math.Min(move/reversal(lastBarIndex, data[highIndex].High), 1)
+			addPivot(Pivot{highIndex, lastBarIndex, true, confidence}, lastBarIndex+1-PROVISIONAL_MIN_BARS)
+		} else if !getHighPivots && direction < 0 && lastBarIndex-lowIndex >= PROVISIONAL_MIN_BARS {
+			move := getHighestHigh(data[lowIndex:]) - data[lowIndex].Low
+			confidence := math.Min(move/reversal(lastBarIndex, data[lowIndex].Low), 1)
+			addPivot(Pivot{lowIndex, lastBarIndex, true, confidence}, lastBarIndex+1-PROVISIONAL_MIN_BARS)
+		}
+	}
+
+	return pivots
+}
+
+func getLowestLow(bars []StockBar) float64 {
+	lowest := math.MaxFloat64
+	for _, bar := range bars {
+		lowest = math.Min(lowest, bar.Low)
+	}
+	return lowest
+}
+
+func getHighestHigh(bars []StockBar) float64 {
+	highest := -math.MaxFloat64
+	for _, bar := range bars {
+		highest = math.Max(highest, bar.High)
+	}
+	return highest
+}
+
+func newPivotDetector(name, ties string) (PivotDetector, error) {
+	switch ties {
+	case TIES_ALL, TIES_FIRST, TIES_LAST:
+	default:
+		return nil, fmt.Errorf("unknown tie rule: %s", ties)
+	}
+
+	switch name {
+	case WINDOW_DETECTOR:
+		return WindowPivotDetector{ties}, nil
+	case ZIGZAG_DETECTOR:
+		return ZigZagPivotDetector{ties}, nil
+	case PERCENT_DETECTOR:
+		return PercentPivotDetector{ties}, nil
+	case FRACTAL_DETECTOR:
+		return FractalPivotDetector{ties}, nil
+	}
+	return nil, fmt.Errorf("unknown pivot detector: %s", name)
+}
+
+// lines through two pivots are only as certain as the least certain of them
+func newLineFromPivots(stock *StockData, start Pivot, startPrice float64, end Pivot, endPrice float64) Line {
+	return Line{
+		X1:          start.Index,
+		Y1:          startPrice,
+		X2:          end.Index,
+		Y2:          endPrice,
+		S1:          stock.Data[start.Index].Session,
+		S2:          stock.Data[end.Index].Session,
+		Provisional: start.Provisional || end.Provisional,
+		Confidence:  math.Min(start.Confidence, end.Confidence),
+		LogScale:    *logScale,
+	}
+}
+
+func getStockData(c chan interface{}, symbol, endMonth, endDay, endYear, startMonth, startDay, startYear string) {
+	url := fmt.Sprintf(YAHOO_FINANCE_API_URL, symbol, endMonth, endDay, endYear, startMonth, startDay, startYear)
+	resp, httpErr := http.Get(url)
+	if httpErr != nil {
+		go getStockData(c, symbol, endMonth, endDay, endYear, startMonth, startDay, startYear)
+		return
+	}
+	defer resp.Body.Close()
+
+	reader := csv.NewReader(resp.Body)
+	rawCSVdata, csvErr := reader.ReadAll()
+
+	if csvErr != nil {
+		c <- nil
+		return
+	}
+
+	data, ok := parseStockData(symbol, rawCSVdata)
+	if !ok {
+		c <- nil
+		return
+	}
+	if *cacheDir != "" {
+		if err := writeStockCache(symbol, rawCSVdata); err != nil {
+			fmt.Printf("Unable to cache data for %s: %v\n", symbol, err)
+		}
+	}
+
+	c <- data
+}
+
+// moves daily bars in the download's CSV format (a header row, then date,
+// open, high, low, close, volume and adjusted close, newest first) to structs
+func parseStockData(symbol string, rawCSVdata [][]string) (StockData, bool) {
+	var oneBar StockBar
+	var allBars []StockBar
+
+	if len(rawCSVdata) == 0 {
+		return StockData{}, false
+	}
+	for _, row := range rawCSVdata[1:] {
+		oneBar.Date = row[0]
+		date, dateErr := time.Parse(TIME_LAYOUT, row[0])
+		if dateErr != nil {
+			return StockData{}, false
+		}
+		oneBar.Time = date
+		oneBar.Open, _ = strconv.ParseFloat(row[1], 64)
+		oneBar.High, _ = strconv.ParseFloat(row[2], 64)
+		oneBar.Low, _ = strconv.ParseFloat(row[3], 64)
+		oneBar.Close, _ = strconv.ParseFloat(row[4], 64)
+		oneBar.Volume, _ = strconv.Atoi(row[5])
+		oneBar.AdjClose, _ = strconv.ParseFloat(row[6], 64)
+		allBars = append([]StockBar{oneBar}, allBars...)
+	}
+
+	// compute ATR
+	var tempATRList []float64
+	for i := 1; i < len(allBars); i++ {
+		allBars[i].ATR = getUpdatedATR(&tempATRList, getTradingRange(allBars[i-1], allBars[i]))
+	}
+
+	var data StockData
+	data.Data = allBars
+	data.Symbol = symbol
+	data.Timeframe = DAILY
+	tradingCalendar.SetSessions(&data)
+
+	return data, true
+}
+
+// keeps the downloads of a symbol in the -cache directory, in the download's
+// own format. cached bars older than the new download are kept, so the cache
+// builds up a symbol's full history, including the final bars of a symbol
+// that is later delisted.
+func writeStockCache(symbol string, rawCSVdata [][]string) error {
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		return err
+	}
+	filename := getStockCacheFile(symbol)
+	rows := append([][]string{}, rawCSVdata...)
+	if cached, err := readStockCache(filename); err == nil && len(rows) > 1 {
+		oldest := rows[len(rows)-1][0]
+		for _, row := range cached[1:] {
+			if len(row) > 0 && row[0] < oldest {
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	var output strings.Builder
+	writer := csv.NewWriter(&output)
+	writer.WriteAll(rows)
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(output.String()), 0644)
+}
+
+func getStockCacheFile(symbol string) string {
+	return filepath.Join(*cacheDir, strings.ToUpper(symbol)+".csv")
+}
+
+func readStockCache(filename string) ([][]string, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(raw))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return rows, nil
+}
+
+func loadCachedStockData(symbol string) (StockData, error) {
+	filename := getStockCacheFile(symbol)
+	rows, err := readStockCache(filename)
+	if err != nil {
+		return StockData{}, err
+	}
+	data, ok := parseStockData(symbol, rows)
+	if !ok {
+		return data, fmt.Errorf("%s: malformed bars", filename)
+	}
+	return data, nil
+}
+
+// reads a symbol's intraday bars from a local CSV file with a header row and
+// timestamp, open, high, low, close and volume columns. timestamps are unix
+// seconds or dates with a time of day, in exchange time unless they carry an
+// offset. bars outside the calendar's trading hours are dropped and the
+// data's timeframe is the smallest spacing between bars of the same day.
+func getIntradayData(c chan interface{}, symbol string) {
+	data, err := loadIntradayData(fmt.Sprintf(*intradayFile, symbol), symbol)
+	if err != nil {
+		fmt.Printf("Unable to read intraday data for %s: %v\n", symbol, err)
+		c <- nil
+		return
+	}
+	c <- data
+}
+
+func loadIntradayData(filename, symbol string) (StockData, error) {
+	data := StockData{Symbol: symbol}
+	location, err := time.LoadLocation(EXCHANGE_TIMEZONE)
+	if err != nil {
+		return data, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return data, err
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return data, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(rows) < 2 {
+		return data, fmt.Errorf("%s: no bars", filename)
+	}
+
+	for i, row := range rows[1:] {
+		if len(row) < 6 {
+			return data, fmt.Errorf("%s:%d: expected 6 columns, got %d", filename, i+2, len(row))
+		}
+		timestamp, err := parseTimestamp(row[0], location)
+		if err != nil {
+			return data, fmt.Errorf("%s:%d: %v", filename, i+2, err)
+		}
+		if !tradingCalendar.IsTradingTime(timestamp) {
+			continue
+		}
+		var bar StockBar
+		bar.Time = timestamp
+		bar.Open, _ = strconv.ParseFloat(row[1], 64)
+		bar.High, _ = strconv.ParseFloat(row[2], 64)
+		bar.Low, _ = strconv.ParseFloat(row[3], 64)
+		bar.Close, _ = strconv.ParseFloat(row[4], 64)
+		bar.Volume, _ = strconv.Atoi(row[5])
+		bar.AdjClose = bar.Close
+		data.Data = append(data.Data, bar)
+	}
+	if len(data.Data) == 0 {
+		return data, fmt.Errorf("%s: no bars within trading hours", filename)
+	}
+	sort.Slice(data.Data, func(i, j int) bool {
+		return data.Data[i].Time.Before(data.Data[j].Time)
+	})
+
+	var interval time.Duration
+	for i := 1; i < len(data.Data); i++ {
+		gap := data.Data[i].Time.Sub(data.Data[i-1].Time)
+		if gap > 0 && startOfDay(data.Data[i].Time).Equal(startOfDay(data.Data[i-1].Time)) && (interval == 0 || gap < interval) {
+			interval = gap
+		}
+	}
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	data.Timeframe = formatInterval(interval)
+	for i := range data.Data {
+		data.Data[i].Date = data.Data[i].Time.Format(INTRADAY_TIME_LAYOUT)
+	}
+
+	var tempATRList []float64
+	for i := 1; i < len(data.Data); i++ {
+		data.Data[i].ATR = getUpdatedATR(&tempATRList, getTradingRange(data.Data[i-1], data.Data[i]))
+	}
+	tradingCalendar.SetSessions(&data)
+
+	return data, nil
+}
+
+// parses an intraday timestamp: unix seconds, RFC 3339 or a date and time of
+// day in the given location
+func parseTimestamp(value string, location *time.Location) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).In(location), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(location), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", INTRADAY_TIME_LAYOUT, "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", value)
+}
+
+// returns the bar interval of an intraday timeframe such as 5m or 1h
+func getIntradayInterval(timeframe string) (time.Duration, bool) {
+	interval, err := time.ParseDuration(timeframe)
+	if err != nil || interval < time.Minute || interval%time.Minute != 0 || interval >= 24*time.Hour {
+		return 0, false
+	}
+	return interval, true
+}
+
+// names an intraday interval the way the -timeframe flag takes it
+func formatInterval(interval time.Duration) string {
+	if interval%time.Hour == 0 {
+		return fmt.Sprintf("%dh", interval/time.Hour)
+	}
+	return fmt.Sprintf("%dm", interval/time.Minute)
+}
+
+// returns the layout bar dates of the timeframe are formatted with
+func getTimeLayout(timeframe string) string {
+	if _, ok := getIntradayInterval(timeframe); ok {
+		return INTRADAY_TIME_LAYOUT
+	}
+	return TIME_LAYOUT
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// aggregates bars into a longer timeframe: daily bars into weekly (ISO week)
+// or monthly bars, and intraday bars into longer intraday intervals or days.
+// each bar opens at the period's first open, closes at its last close, spans
+// its extremes and sums its volume. bars are dated by the period's last source
+// bar, so a period that is still in progress is kept and marked partial.
+func resample(stock *StockData, timeframe string) StockData {
+	resampled := StockData{Symbol: stock.Symbol, Timeframe: timeframe}
+	if timeframe == stock.Timeframe || len(stock.Data) == 0 {
+		resampled.Data = append(resampled.Data, stock.Data...)
+		return resampled
+	}
+	layout := getTimeLayout(timeframe)
+
+	var bar StockBar
+	for i, source := range stock.Data {
+		if i > 0 && getPeriodKey(source.Time, timeframe) == getPeriodKey(bar.Time, timeframe) {
+			bar.High = math.Max(bar.High, source.High)
+			bar.Low = math.Min(bar.Low, source.Low)
+			bar.Close = source.Close
+			bar.AdjClose = source.AdjClose
+			bar.Volume += source.Volume
+			bar.Date = source.Time.Format(layout)
+			bar.Time = source.Time
+			continue
+		}
+		if i > 0 {
+			resampled.Data = append(resampled.Data, bar)
+		}
+		bar = source
+		bar.Date = source.Time.Format(layout)
+		bar.ATR = 0
+	}
+	last := stock.Data[len(stock.Data)-1].Time
+	next := tradingCalendar.AddSessions(last, 1)
+	if interval, ok := getIntradayInterval(stock.Timeframe); ok {
+		next = tradingCalendar.AddBars(last, 1, interval)
+	}
+	bar.Partial = getPeriodKey(next, timeframe) == getPeriodKey(last, timeframe)
+	resampled.Data = append(resampled.Data, bar)
+
+	var tempATRList []float64
+	for i := 1; i < len(resampled.Data); i++ {
+		resampled.Data[i].ATR = getUpdatedATR(&tempATRList, getTradingRange(resampled.Data[i-1], resampled.Data[i]))
+	}
+	tradingCalendar.SetSessions(&resampled)
+
+	return resampled
+}
+
+// identifies the intraday bar, day, week or month a time falls in. intraday
+// bars are counted from the open of the trading hours.
+func getPeriodKey(date time.Time, timeframe string) int {
+	day := date.Year()*10000 + int(date.Month())*100 + date.Day()
+	if interval, ok := getIntradayInterval(timeframe); ok {
+		return day*10000 + tradingCalendar.getSlot(date, interval)
+	}
+	switch timeframe {
+	case DAILY:
+		return day
+	case MONTHLY:
+		return date.Year()*100 + int(date.Month())
+	}
+	year, week := date.ISOWeek()
+	return year*100 + week
+}
+
+// returns the higher timeframe's lines and zones within ALIGN_ATR_MULTIPLE
+// daily ATRs of the setup's intersections. lines are projected to the daily
+// last bar's date.
+func getAlignment(stock *StockData, analysis *StockAnalysis, higher *StockData) ([]Intersection, []Zone) {
+	if len(higher.Data) == 0 {
+		return nil, nil
+	}
+	higherAnalysis, _ := analyzeStock(higher, analysis.Side)
+	tolerance := ALIGN_ATR_MULTIPLE * getCurrentATR(stock)
+	lastBar := stock.Data[len(stock.Data)-1]
+
+	near := func(price float64) bool {
+		for _, intersection := range analysis.Setup {
+			if math.Abs(intersection.Price-price) <= tolerance {
+				return true
+			}
+		}
+		return false
+	}
+
+	var lines []Intersection
+	sets := []struct {
+		Type  string
+		Lines []Line
+	}{{TREND_CHANNEL_LINE, higherAnalysis.TrendChannelLines}, {TREND_LINE, higherAnalysis.TrendLines}, {higherAnalysis.GetLevelType(), higherAnalysis.HorizontalLines}}
+	for _, set := range sets {
+		for _, line := range set.Lines {
+			price := line.ProjectDate(higher, &tradingCalendar, lastBar.Time)
+			if near(price) {
+				lines = append(lines, Intersection{Line: line, Price: price, Date: lastBar.Date, Type: set.Type})
+			}
+		}
+	}
+
+	var zones []Zone
+	for _, zone := range higherAnalysis.Zones {
+		for _, intersection := range analysis.Setup {
+			if intersection.Price >= zone.Low-tolerance && intersection.Price <= zone.High+tolerance {
+				zones = append(zones, zone)
+				break
+			}
+		}
+	}
+
+	return lines, zones
+}
+
+func getTradingRange(prevBar, currBar StockBar) float64 {
+	// high and low of today
+	max := math.Abs(currBar.High - currBar.Low)
+	// today's high and yesterday's close
+	currHigh := math.Abs(currBar.High - prevBar.Close)
+	if currHigh > max {
+		max = currHigh
+	}
+	// today's low and yesterday's close
+	currLow := math.Abs(currBar.Low - prevBar.Close)
+	if currLow > max {
+		max = currLow
+	}
+
+	return max
+}
+
+func getUpdatedATR(list *[]float64, newValue float64) float64 {
+	if len(*list) < ATR_WINDOW {
+		*list = append(*list, newValue)
+		return -1.0
+	} else {
+		*list = append((*list)[1:], newValue)
+		sum := 0.0
+		for _, val := range *list {
+			sum += val
+		}
+		return sum / float64(ATR_WINDOW)
+	}
+}
+
+// returns the configured technical pre-filters in the order they are applied.
+// the relative strength filter is only added when index data is available.
+func getTechnicalFilters(index *StockData) []TechnicalFilter {
+	filters := []TechnicalFilter{
+		{"Minimum Bar Count", func(stock *StockData) bool {
+			return len(stock.Data) >= *minBars
+		}},
+		{"Minimum Price", func(stock *StockData) bool {
+			return stock.Data[len(stock.Data)-1].Close >= *minPrice
+		}},
+		{"Minimum Average Dollar Volume", func(stock *StockData) bool {
+			return getAverageDollarVolume(stock, FILTER_LOOKBACK) >= *minDollarVolume
+		}},
+		{"Maximum Gap Count", func(stock *StockData) bool {
+			return getGapCount(stock, GAP_PERCENT) <= *maxGaps
+		}},
+		{"ATR Percent Range", func(stock *StockData) bool {
+			atrPercent, ok := getATRPercent(stock)
+			return ok && atrPercent >= *minATRPercent && atrPercent <= *maxATRPercent
+		}},
+	}
+
+	if index != nil {
+		filters = append(filters, TechnicalFilter{"Relative Strength", func(stock *StockData) bool {
+			rs, ok := getRelativeStrength(stock, index, RS_LOOKBACK)
+			return ok && rs >= *minRelativeStrength
+		}})
+	}
+
+	return filters
+}
+
+// returns the name of the first filter the stock fails
+func applyTechnicalFilters(stock *StockData, filters []TechnicalFilter) (string, bool) {
+	if len(filters) > 0 && len(stock.Data) == 0 {
+		return filters[0].Name, false
+	}
+	for _, filter := range filters {
+		if !filter.Passes(stock) {
+			return filter.Name, false
+		}
+	}
+	return "", true
+}
+
+func getAverageDollarVolume(stock *StockData, lookback int) float64 {
+	data := stock.Data
+	start := len(data) - lookback
+	if start < 0 {
+		start = 0
+	}
+	if start == len(data) {
+		return 0
+	}
+
+	sum := 0.0
+	for _, bar := range data[start:] {
+		sum += bar.Close * float64(bar.Volume)
+	}
+	return sum / float64(len(data)-start)
+}
+
+// counts bars that open more than gapPercent away from the previous close
+func getGapCount(stock *StockData, gapPercent float64) int {
+	gaps := 0
+	for i := 1; i < len(stock.Data); i++ {
+		prevClose := stock.Data[i-1].Close
+		if prevClose > 0 && math.Abs(stock.Data[i].Open-prevClose)/prevClose > gapPercent {
+			gaps++
+		}
+	}
+	return gaps
+}
+
+func getATRPercent(stock *StockData) (float64, bool) {
+	lastBar := stock.Data[len(stock.Data)-1]
+	if lastBar.ATR <= 0 || lastBar.Close <= 0 {
+		return 0, false
+	}
+	return lastBar.ATR / lastBar.Close, true
+}
+
+// returns the stock's return relative to the index weighted over the RS
+// rating lookbacks: the last quarter counts twice, the last half year and year
+// once each. lookbacks longer than the stock's history are left out, but the
+// quarter is required.
+func getRSScore(stock, index *StockData) (float64, bool) {
+	lookbacks := []struct {
+		Bars   int
+		Weight float64
+	}{{RS_RATING_QUARTER_BARS, RS_RATING_QUARTER_WEIGHT}, {RS_RATING_HALF_BARS, RS_RATING_HALF_WEIGHT}, {RS_RATING_YEAR_BARS, RS_RATING_YEAR_WEIGHT}}
+
+	score, totalWeight := 0.0, 0.0
+	for i, lookback := range lookbacks {
+		rs, ok := getRelativeStrength(stock, index, lookback.Bars)
+		if !ok {
+			if i == 0 {
+				return 0, false
+			}
+			continue
+		}
+		score += rs * lookback.Weight
+		totalWeight += lookback.Weight
+	}
+	return score / totalWeight, true
+}
+
+// percentile ranks the stocks' RS scores into ratings from 1 to 99, the share
+// of the other stocks with a lower score. stocks without a score get no
+// rating.
+func getRSRatings(stocks []StockData, index *StockData) map[string]float64 {
+	scores := make(map[string]float64)
+	var sorted []float64
+	for i := range stocks {
+		if score, ok := getRSScore(&stocks[i], index); ok {
+			scores[stocks[i].Symbol] = score
+			sorted = append(sorted, score)
+		}
+	}
+	sort.Float64s(sorted)
+
+	ratings := make(map[string]float64)
+	for symbol, score := range scores {
+		rating := 99.0
+		if len(sorted) > 1 {
+			below := sort.SearchFloat64s(sorted, score)
+			rating = math.Round(1 + 98*float64(below)/float64(len(sorted)-1))
+		}
+		ratings[symbol] = rating
+	}
+	return ratings
+}
+
+// returns the stock's return over the lookback divided by the index's return
+// over the same dates, both expressed as growth multiples
+func getRelativeStrength(stock, index *StockData, lookback int) (float64, bool) {
+	data := stock.Data
+	if len(data) <= lookback {
+		return 0, false
+	}
+	startBar, endBar := data[len(data)-1-lookback], data[len(data)-1]
+
+	indexCloses := make(map[string]float64)
+	for _, bar := range index.Data {
+		indexCloses[bar.Date] = bar.Close
+	}
+	indexStart, startOk := indexCloses[startBar.Date]
+	indexEnd, endOk := indexCloses[endBar.Date]
+	if !startOk || !endOk || startBar.Close <= 0 || indexStart <= 0 || indexEnd <= 0 {
+		return 0, false
+	}
+
+	return (endBar.Close / startBar.Close) / (indexEnd / indexStart), true
+}
+
+type Fundamentals struct {
+	Symbol   string
+	Industry string
+	Values   map[string]float64
+}
+
+type FundamentalRule struct {
+	Text      string
+	Field     string
+	Operator  string
+	Value     float64
+	Upper     float64
+	Preferred bool
+	Portfolio bool
+}
+
+type RuleResult struct {
+	Rule   FundamentalRule
+	Value  float64
+	Known  bool
+	Passed bool
+}
+
+type ScreenResult struct {
+	Symbol  string
+	Passed  bool
+	Results []RuleResult
+}
+
+func (r *RuleResult) ToString() string {
+	status := "PASS"
+	if !r.Passed {
+		status = "FAIL"
+	}
+	if r.Rule.Preferred {
+		status += " (preferred)"
+	}
+	if !r.Known {
+		return fmt.Sprintf("%s - %s - no data", status, r.Rule.Text)
+	}
+	return fmt.Sprintf("%s - %s - %s", status, r.Rule.Text, strconv.FormatFloat(r.Value, 'f', -1, 64))
+}
+
+func (s *ScreenResult) ToString() string {
+	status := "PASS"
+	if !s.Passed {
+		status = "FAIL"
+	}
+	str := fmt.Sprintf("=============== %s - %s ===============\n", s.Symbol, status)
+	for _, result := range s.Results {
+		str += result.ToString() + "\n"
+	}
+	return str
+}
+
+// evaluates a rule against a single value
+func (r *FundamentalRule) Evaluate(value float64) bool {
+	switch r.Operator {
+	case "<":
+		return value < r.Value
+	case "<=":
+		return value <= r.Value
+	case ">":
+		return value > r.Value
+	case ">=":
+		return value >= r.Value
+	case "==":
+		return value == r.Value
+	case "!=":
+		return value != r.Value
+	case "between":
+		return value >= r.Value && value <= r.Upper
+	}
+	return false
+}
+
+// screens one symbol against the per-stock rules. a symbol passes when every
+// required rule passes; preferred rules are reported but never reject.
+func screenFundamentals(fundamentals *Fundamentals, rules []FundamentalRule) ScreenResult {
+	screen := ScreenResult{Passed: true}
+	if fundamentals != nil {
+		screen.Symbol = fundamentals.Symbol
+	}
+
+	for _, rule := range rules {
+		if rule.Portfolio {
+			continue
+		}
+		result := RuleResult{Rule: rule}
+		if fundamentals != nil {
+			result.Value, result.Known = fundamentals.Values[rule.Field]
+		}
+		result.Passed = result.Known && rule.Evaluate(result.Value)
+		if !result.Passed && !rule.Preferred {
+			screen.Passed = false
+		}
+		screen.Results = append(screen.Results, result)
+	}
+
+	return screen
+}
+
+// evaluates the portfolio rules (e.g. "portfolio industries >= 5") against the
+// final list of selected symbols. industries missing from the fundamentals
+// snapshot are taken from the symbol metadata.
+func screenPortfolio(symbols []string, snapshot map[string]*Fundamentals, metadata map[string]*SymbolMetadata, rules []FundamentalRule) []RuleResult {
+	industries := make(map[string]bool)
+	sectors := make(map[string]bool)
+	for _, symbol := range symbols {
+		industry, sector := getIndustry(metadata, symbol)
+		if fundamentals, ok := snapshot[strings.ToUpper(symbol)]; ok && fundamentals.Industry != "" {
+			industry = fundamentals.Industry
+		}
+		if industry != UNCLASSIFIED {
+			industries[industry] = true
+		}
+		if sector != "" {
+			sectors[sector] = true
+		}
+	}
+	values := map[string]float64{
+		"stocks":     float64(len(symbols)),
+		"industries": float64(len(industries)),
+		"sectors":    float64(len(sectors)),
+	}
+
+	var results []RuleResult
+	for _, rule := range rules {
+		if !rule.Portfolio {
+			continue
+		}
+		result := RuleResult{Rule: rule}
+		result.Value, result.Known = values[rule.Field]
+		result.Passed = result.Known && rule.Evaluate(result.Value)
+		results = append(results, result)
+	}
+	return results
+}
+
+// parses the fundamental screen DSL. each non-empty line holds one rule:
+//
+//	[prefer] [portfolio] <field> <op> <number>
+//	[prefer] [portfolio] <field> between <number> and <number>
+//
+// where op is one of < <= > >= == != and numbers may carry a K, M or B
+// suffix. everything after a # is a comment.
+func parseFundamentalRules(text string) ([]FundamentalRule, error) {
+	var rules []FundamentalRule
+
+	for lineNumber, line := range strings.Split(text, "\n") {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		rule := FundamentalRule{Text: strings.Join(tokens, " ")}
+		for len(tokens) > 0 && (tokens[0] == "prefer" || tokens[0] == "portfolio") {
+			if tokens[0] == "prefer" {
+				rule.Preferred = true
+			} else {
+				rule.Portfolio = true
+			}
+			tokens = tokens[1:]
+		}
+
+		var err error
+		if len(tokens) == 5 && tokens[1] == "between" && tokens[3] == "and" {
+			rule.Field, rule.Operator = tokens[0], tokens[1]
+			if rule.Value, err = parseRuleNumber(tokens[2]); err == nil {
+				rule.Upper, err = parseRuleNumber(tokens[4])
+			}
+		} else if len(tokens) == 3 && isRuleOperator(tokens[1]) {
+			rule.Field, rule.Operator = tokens[0], tokens[1]
+			rule.Value, err = parseRuleNumber(tokens[2])
+		} else {
+			err = fmt.Errorf("expected \"<field> <op> <number>\"")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %v", lineNumber+1, rule.Text, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func isRuleOperator(op string) bool {
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+func parseRuleNumber(token string) (float64, error) {
+	multiple := 1.0
+	switch strings.ToUpper(token[len(token)-1:]) {
+	case "K":
+		multiple = 1e3
+	case "M":
+		multiple = 1e6
+	case "B":
+		multiple = 1e9
+	}
+	if multiple != 1.0 {
+		token = token[:len(token)-1]
+	}
+	value, err := strconv.ParseFloat(strings.TrimSuffix(token, "%"), 64)
+	return value * multiple, err
+}
+
+func loadFundamentalRules(filename string) ([]FundamentalRule, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseFundamentalRules(string(raw))
+}
+
+// loads a fundamentals snapshot keyed by symbol. json snapshots hold an array
+// of objects; csv snapshots have a header row. in both, "symbol" and
+// "industry" are text and every other field is numeric. missing or empty
+// values are left out so that rules on them fail as "no data".
+func loadFundamentals(filename string) (map[string]*Fundamentals, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []map[string]interface{}
+	if strings.HasSuffix(strings.ToLower(filename), ".json") {
+		if err := json.Unmarshal(raw, &records); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	} else {
+		rows, err := csv.NewReader(strings.NewReader(string(raw))).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if len(rows) == 0 {
+			return nil, fmt.Errorf("%s: missing header", filename)
+		}
+		header := rows[0]
+		for _, row := range rows[1:] {
+			record := make(map[string]interface{})
+			for i, cell := range row {
+				if i < len(header) {
+					record[strings.ToLower(strings.TrimSpace(header[i]))] = strings.TrimSpace(cell)
+				}
+			}
+			records = append(records, record)
+		}
+	}
+
+	snapshot := make(map[string]*Fundamentals)
+	for _, record := range records {
+		fundamentals := Fundamentals{Values: make(map[string]float64)}
+		for key, value := range record {
+			// json keys are matched like the csv header, e.g. "EPS" as "eps"
+			field := strings.ToLower(strings.TrimSpace(key))
+			switch field {
+			case "symbol":
+				fundamentals.Symbol = strings.ToUpper(strings.TrimSpace(fmt.Sprint(value)))
+			case "industry":
+				fundamentals.Industry = fmt.Sprint(value)
+			default:
+				switch v := value.(type) {
+				case float64:
+					fundamentals.Values[field] = v
+				case string:
+					if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+						fundamentals.Values[field] = parsed
+					}
+				}
+			}
+		}
+		if fundamentals.Symbol != "" {
+			snapshot[fundamentals.Symbol] = &fundamentals
+		}
+	}
+
+	return snapshot, nil
+}
+
+type SymbolMetadata struct {
+	Symbol   string
+	Sector   string
+	Industry string
+	Exchange string
+}
+
+// IndustryGroup aggregates the scanned symbols of one industry. the moving
+// average fields are the fractions of members with enough bars that closed
+// above the average.
+type IndustryGroup struct {
+	Industry     string
+	Sector       string
+	Members      int
+	MedianRS     float64
+	AboveShortMA float64
+	AboveLongMA  float64
+	Setups       int
+}
+
+func (g *IndustryGroup) ToString() string {
+	name := g.Industry
+	if g.Sector != "" {
+		name += " (" + g.Sector + ")"
+	}
+	rs := "n/a"
+	if g.MedianRS > 0 {
+		rs = fmt.Sprintf("%.0f", g.MedianRS)
+	}
+	return fmt.Sprintf("%s - Members: %d - Median RS: %s - Above %d-bar MA: %.0f%% - Above %d-bar MA: %.0f%% - Setups: %d",
+		name, g.Members, rs, SHORT_MA_BARS, g.AboveShortMA*100, LONG_MA_BARS, g.AboveLongMA*100, g.Setups)
+}
+
+// loads symbol metadata keyed by symbol from a CSV file whose header row names
+// the symbol, sector, industry and exchange columns in any order
+func loadSymbolMetadata(filename string) (map[string]*SymbolMetadata, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(raw))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: missing header", filename)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["symbol"]; !ok {
+		return nil, fmt.Errorf("%s: missing symbol column", filename)
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	metadata := make(map[string]*SymbolMetadata)
+	for _, row := range rows[1:] {
+		symbol := strings.ToUpper(field(row, "symbol"))
+		if symbol == "" {
+			continue
+		}
+		metadata[symbol] = &SymbolMetadata{symbol, field(row, "sector"), field(row, "industry"), field(row, "exchange")}
+	}
+	return metadata, nil
+}
+
+// returns the symbol's industry and sector, UNCLASSIFIED and no sector when
+// the metadata does not know the industry
+func getIndustry(metadata map[string]*SymbolMetadata, symbol string) (string, string) {
+	if meta, ok := metadata[strings.ToUpper(symbol)]; ok && meta.Industry != "" {
+		return meta.Industry, meta.Sector
+	}
+	return UNCLASSIFIED, ""
+}
+
+// groups the scanned stocks by industry and aggregates their RS ratings and
+// closes relative to the SHORT_MA_BARS and LONG_MA_BARS moving averages
+func getIndustryGroups(stocks []StockData, metadata map[string]*SymbolMetadata) map[string]*IndustryGroup {
+	groups := make(map[string]*IndustryGroup)
+	ratings := make(map[string][]float64)
+	aboveShort, shortCount := make(map[string]int), make(map[string]int)
+	aboveLong, longCount := make(map[string]int), make(map[string]int)
+
+	for i := range stocks {
+		industry, sector := getIndustry(metadata, stocks[i].Symbol)
+		group, ok := groups[industry]
+		if !ok {
+			group = &IndustryGroup{Industry: industry, Sector: sector}
+			groups[industry] = group
+		}
+		group.Members++
+		if rating, ok := rsRatings[stocks[i].Symbol]; ok {
+			ratings[industry] = append(ratings[industry], rating)
+		}
+		if above, ok := isAboveMovingAverage(&stocks[i], SHORT_MA_BARS); ok {
+			shortCount[industry]++
+			if above {
+				aboveShort[industry]++
+			}
+		}
+		if above, ok := isAboveMovingAverage(&stocks[i], LONG_MA_BARS); ok {
+			longCount[industry]++
+			if above {
+				aboveLong[industry]++
+			}
+		}
+	}
+
+	for industry, group := range groups {
+		group.MedianRS = getMedian(ratings[industry])
+		if shortCount[industry] > 0 {
+			group.AboveShortMA = float64(aboveShort[industry]) / float64(shortCount[industry])
+		}
+		if longCount[industry] > 0 {
+			group.AboveLongMA = float64(aboveLong[industry]) / float64(longCount[industry])
+		}
+	}
+	return groups
+}
+
+// reports whether the last close is above the simple moving average of the
+// last bars closes, and whether the stock has that many bars
+func isAboveMovingAverage(stock *StockData, bars int) (bool, bool) {
+	data := stock.Data
+	if len(data) < bars {
+		return false, false
+	}
+	sum := 0.0
+	for _, bar := range data[len(data)-bars:] {
+		sum += bar.Close
+	}
+	return data[len(data)-1].Close > sum/float64(bars), true
+}
+
+func getMedian(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// orders the industry groups strongest first: by median RS rating, then by
+// the share of members above the long moving average
+func sortIndustryGroups(groups map[string]*IndustryGroup) []*IndustryGroup {
+	var sorted []*IndustryGroup
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].MedianRS != sorted[j].MedianRS {
+			return sorted[i].MedianRS > sorted[j].MedianRS
+		}
+		if sorted[i].AboveLongMA != sorted[j].AboveLongMA {
+			return sorted[i].AboveLongMA > sorted[j].AboveLongMA
+		}
+		return sorted[i].Industry < sorted[j].Industry
+	})
+	return sorted
+}
+
+// ScanResult is the machine-readable record of one symbol's setup. The text
+// report, the JSON Lines file and the CSV file are all produced from it.
+type ScanResult struct {
+	Symbol          string             `json:"symbol"`
+	Date            string             `json:"date"`
+	Side            string             `json:"side"`
+	SetupType       string             `json:"setup_type"`
+	Rank            int                `json:"rank"`
+	Score           float64            `json:"score"`
+	ScoreComponents map[string]float64 `json:"score_components"`
+	LastClose       float64            `json:"last_close"`
+	RSRating        float64            `json:"rs_rating,omitempty"`
+	Sector          string             `json:"sector,omitempty"`
+	Industry        string             `json:"industry,omitempty"`
+	Regime          string             `json:"regime,omitempty"`
+	RegimeDate      string             `json:"regime_date,omitempty"`
+	BestSetup       []LineResult       `json:"best_setup"`
+	AllLines        []LineResult       `json:"all_lines"`
+	Support         []LineResult       `json:"support,omitempty"`
+	Resistance      []LineResult       `json:"resistance,omitempty"`
+	Fundamentals    []RuleOutput       `json:"fundamentals,omitempty"`
+	Timeframe       string             `json:"timeframe"`
+	PartialBar      bool               `json:"partial_bar,omitempty"`
+	HigherTimeframe string             `json:"higher_timeframe,omitempty"`
+	AlignedLines    []LineResult       `json:"aligned_lines,omitempty"`
+	AlignedZones    []ZoneResult       `json:"aligned_zones,omitempty"`
+	Patterns        []PatternResult    `json:"patterns,omitempty"`
+	SupportZone     *ZoneResult        `json:"support_zone,omitempty"`
+	ResistanceZone  *ZoneResult        `json:"resistance_zone,omitempty"`
+}
+
+type PatternResult struct {
+	Name         string         `json:"name"`
+	Direction    string         `json:"direction"`
+	Pivots       []PatternPivot `json:"pivots"`
+	Target       float64        `json:"target"`
+	Invalidation float64        `json:"invalidation"`
+}
+
+type PatternPivot struct {
+	Date  string  `json:"date"`
+	Index int     `json:"index"`
+	Low   float64 `json:"low"`
+	High  float64 `json:"high"`
+}
+
+type ZoneResult struct {
+	Type           string  `json:"type"`
+	Low            float64 `json:"low"`
+	High           float64 `json:"high"`
+	Touches        int     `json:"touches"`
+	FirstTouchDate string  `json:"first_touch_date"`
+	LastTouchDate  string  `json:"last_touch_date"`
+	Volume         float64 `json:"volume"`
+	Strength       float64 `json:"strength"`
+	Reversal       bool    `json:"reversal"`
+}
+
+type LineResult struct {
+	Type           string   `json:"type"`
+	StartDate      string   `json:"start_date"`
+	StartPrice     float64  `json:"start_price"`
+	StartIndex     int      `json:"start_index"`
+	EndDate        string   `json:"end_date"`
+	EndPrice       float64  `json:"end_price"`
+	EndIndex       int      `json:"end_index"`
+	Slope          float64  `json:"slope"`
+	SlopePercent   float64  `json:"slope_percent"`
+	LogScale       bool     `json:"log_scale"`
+	Projection     float64  `json:"projection"`
+	ProjectionDate string   `json:"projection_date"`
+	ForwardPrice   float64  `json:"forward_price"`
+	ForwardDate    string   `json:"forward_date"`
+	Provisional    bool     `json:"provisional"`
+	Confidence     float64  `json:"confidence"`
+	Touches        int      `json:"touches"`
+	LastTouchDate  string   `json:"last_touch_date"`
+	Violations     int      `json:"violations"`
+	Break          string   `json:"break,omitempty"`
+	Reaction       string   `json:"reaction,omitempty"`
+	BarPatterns    []string `json:"bar_patterns,omitempty"`
+	CloseLocation  float64  `json:"close_location"`
+}
+
+type RuleOutput struct {
+	Rule      string  `json:"rule"`
+	Value     float64 `json:"value"`
+	Known     bool    `json:"known"`
+	Passed    bool    `json:"passed"`
+	Preferred bool    `json:"preferred"`
+	Text      string  `json:"-"`
+}
+
+const TEXT_OUTPUT_TEMPLATE string = `=============== {{.Symbol}}{{if eq .Side "short"}} (Short){{end}} ===============
+{{if .Regime}}Market Regime: {{.Regime}}{{if .RegimeDate}} ({{.RegimeDate}}){{end}}
+{{end}}{{if .Industry}}Industry: {{.Industry}}{{if .Sector}} ({{.Sector}}){{end}}
+{{end}}{{if ne .Timeframe "daily"}}Timeframe: {{.Timeframe}}{{if .PartialBar}} (last bar partial){{end}}
+{{end}}Score: {{printf "%.2f" .Score}} (Rank {{.Rank}}){{if .RSRating}} - RS Rating: {{printf "%.0f" .RSRating}}{{end}}
+{{if .Fundamentals}}----- Fundamentals -----
+{{range .Fundamentals}}{{.Text}}
+{{end}}{{end}}++++++++++++ Best Setup ++++++++++++
+{{range .BestSetup}}{{template "line" .}}{{end}}{{range .Support}}{{template "level" .}}{{end}}{{range .Resistance}}{{template "level" .}}{{end}}++++++++++++ All Lines ++++++++++++
+{{range .AllLines}}{{template "line" .}}{{end}}{{range .Support}}{{template "level" .}}{{end}}{{range .Resistance}}{{template "level" .}}{{end}}
+{{- if .Patterns}}++++++++++++ Patterns ++++++++++++
+{{range .Patterns}}{{.Name}} ({{.Direction}}) - Target {{price .Target}} - Invalidation {{price .Invalidation}}
+{{end}}{{end}}
+{{- if or .SupportZone .ResistanceZone}}++++++++++++ Nearest Zones ++++++++++++
+{{with .ResistanceZone}}{{template "zone" .}}{{end}}{{with .SupportZone}}{{template "zone" .}}{{end}}{{end}}
+{{- if or .AlignedLines .AlignedZones}}++++++++++++ {{title .HigherTimeframe}} Alignment ++++++++++++
+{{range .AlignedLines}}{{.Type}} at {{price .Projection}} - {{.StartDate}} to {{.EndDate}}
+{{end}}{{range .AlignedZones}}{{template "zone" .}}{{end}}{{end}}
+{{- define "line"}}----- {{.Type}}{{if .Provisional}} (Provisional - {{printf "%.0f" (percent .Confidence)}}% Confidence){{end}} -----
+{{.StartDate}} - {{price .StartPrice}} - {{.StartIndex}}
+{{.EndDate}} - {{price .EndPrice}} - {{.EndIndex}}
+Crosses {{price .Projection}} on {{.ProjectionDate}}{{if .LogScale}} - Slope: {{printf "%.2f" .SlopePercent}}% per bar{{end}}
+{{if .ForwardDate}}Projects {{price .ForwardPrice}} on {{.ForwardDate}}
+{{end}}Touches: {{.Touches}} - Last Touch: {{.LastTouchDate}}{{if .Violations}} - Violations: {{.Violations}}{{end}}
+{{if .Reaction}}Break: {{.Break}} - Reaction: {{.Reaction}}{{if .BarPatterns}} ({{join .BarPatterns ", "}}){{end}} - Close Location: {{printf "%.2f" .CloseLocation}}
+{{end}}{{end}}
+{{- define "zone"}}{{.Type}} Zone {{price .Low}} - {{price .High}} - Strength {{printf "%.0f" .Strength}} - Touches: {{.Touches}} - Last Touch: {{.LastTouchDate}}{{if .Reversal}} - {{if eq .Type "Support"}}Former Resistance{{else}}Former Support{{end}}{{end}}
+{{end}}
+{{- define "level"}}----- {{.Type}}{{if .Provisional}} (Provisional - {{printf "%.0f" (percent .Confidence)}}% Confidence){{end}} -----
+{{.Type}} at {{price .StartPrice}}
+{{end}}`
+
+func newScanResult(stock *StockData, analysis *StockAnalysis) ScanResult {
+	lastBar := stock.Data[len(stock.Data)-1]
+	levelType := analysis.GetLevelType()
+	result := ScanResult{
+		Symbol:    stock.Symbol,
+		Date:      lastBar.Date,
+		Side:      analysis.Side,
+		SetupType: getSetupType(analysis.Setup, levelType, len(analysis.HorizontalLines)),
+		LastClose: lastBar.Close,
+		Timeframe: DAILY,
+	}
+	if stock.Timeframe != "" {
+		result.Timeframe = stock.Timeframe
+		result.PartialBar = lastBar.Partial
+	}
+
+	for _, intersection := range analysis.Setup {
+		result.BestSetup = append(result.BestSetup, newIntersectionResult(stock, intersection))
+	}
+	for _, set := range [][]Intersection{analysis.TrendChannelIntersections, analysis.TrendLineIntersections} {
+		for _, intersection := range set {
+			result.AllLines = append(result.AllLines, newIntersectionResult(stock, intersection))
+		}
+	}
+	for _, line := range analysis.HorizontalLines {
+		level := newLineResult(stock, levelType, line, line.Y1)
+		if levelType == RESISTANCE {
+			result.Resistance = append(result.Resistance, level)
+		} else {
+			result.Support = append(result.Support, level)
+		}
+	}
+
+	for _, pattern := range analysis.Patterns {
+		result.Patterns = append(result.Patterns, newPatternResult(stock, pattern))
+	}
+
+	below, above := getNearestZones(analysis.Zones, lastBar.Close)
+	if below >= 0 {
+		zone := newZoneResult(stock, analysis.Zones[below])
+		result.SupportZone = &zone
+	}
+	if above >= 0 {
+		zone := newZoneResult(stock, analysis.Zones[above])
+		result.ResistanceZone = &zone
+	}
+
+	result.Score = analysis.Score.Total
+	result.ScoreComponents = analysis.Score.Components
+	result.RSRating = rsRatings[stock.Symbol]
+
+	return result
+}
+
+func newIntersectionResult(stock *StockData, intersection Intersection) LineResult {
+	result := newLineResult(stock, intersection.Type, intersection.Line, intersection.Price)
+	result.Break = intersection.Break
+	result.Reaction = intersection.Reaction
+	result.BarPatterns = intersection.BarPatterns
+	result.CloseLocation = intersection.CloseLocation
+	return result
+}
+
+// lines are also projected -project trading sessions past the last bar
+func newLineResult(stock *StockData, lineType string, line Line, projection float64) LineResult {
+	result := LineResult{
+		Type:           lineType,
+		StartDate:      stock.Data[line.X1].Date,
+		StartPrice:     line.Y1,
+		StartIndex:     line.X1,
+		EndDate:        stock.Data[line.X2].Date,
+		EndPrice:       line.Y2,
+		EndIndex:       line.X2,
+		Slope:          line.Slope(),
+		SlopePercent:   line.SlopePercent(),
+		LogScale:       line.LogScale,
+		Projection:     projection,
+		ProjectionDate: stock.Data[len(stock.Data)-1].Date,
+		Provisional:    line.Provisional,
+		Confidence:     line.Confidence,
+		Touches:        line.Touches,
+		LastTouchDate:  stock.Data[line.LastTouch].Date,
+		Violations:     line.Violations,
+	}
+	if *projectionSessions > 0 {
+		forwardDate := tradingCalendar.AddSessions(stock.Data[len(stock.Data)-1].Time, *projectionSessions)
+		result.ForwardPrice = line.ProjectDate(stock, &tradingCalendar, forwardDate)
+		result.ForwardDate = forwardDate.Format(getTimeLayout(stock.Timeframe))
+	}
+	return result
+}
+
+type ApproachResult struct {
+	Symbol          string     `json:"symbol"`
+	Date            string     `json:"date"`
+	Side            string     `json:"side"`
+	LastClose       float64    `json:"last_close"`
+	Line            LineResult `json:"line"`
+	Distance        float64    `json:"distance"`
+	DistanceATR     float64    `json:"distance_atr"`
+	DistancePercent float64    `json:"distance_percent"`
+	BarsToContact   float64    `json:"bars_to_contact"`
+}
+
+func newApproachResult(stock *StockData, side string, approach Approach) ApproachResult {
+	lastBar := stock.Data[len(stock.Data)-1]
+	return ApproachResult{
+		Symbol:          stock.Symbol,
+		Date:            lastBar.Date,
+		Side:            side,
+		LastClose:       lastBar.Close,
+		Line:            newLineResult(stock, approach.Type, approach.Line, approach.Price),
+		Distance:        approach.Distance,
+		DistanceATR:     approach.DistanceATR,
+		DistancePercent: approach.DistancePercent,
+		BarsToContact:   approach.BarsToContact,
+	}
+}
+
+func (a *ApproachResult) ToString() string {
+	direction := "below"
+	if a.Distance > 0 {
+		direction = "above"
+	}
+	symbol := a.Symbol
+	if a.Side == SHORT_SIDE {
+		symbol += " (Short)"
+	}
+	str := fmt.Sprintf("%s - %s at $%.2f - %.2f ATR (%.2f%%) %s", symbol, a.Line.Type, a.Line.Projection, math.Abs(a.DistanceATR), math.Abs(a.DistancePercent)*100, direction)
+	if a.BarsToContact >= 0 {
+		str += fmt.Sprintf(" - contact in ~%.0f bars", math.Ceil(a.BarsToContact))
+	}
+	return str
+}
+
+// lists the approaching lines, closest first
+func renderApproachOutput(approaching []ApproachResult) string {
+	sorted := append([]ApproachResult{}, approaching...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return math.Abs(sorted[i].DistanceATR) < math.Abs(sorted[j].DistanceATR)
+	})
+
+	output := "=============== Approaching Lines ===============\n"
+	for _, approach := range sorted {
+		output += approach.ToString() + "\n"
+	}
+	return output
+}
+
+func newPatternResult(stock *StockData, pattern Pattern) PatternResult {
+	result := PatternResult{
+		Name:         pattern.Name,
+		Direction:    pattern.Direction,
+		Target:       pattern.Target,
+		Invalidation: pattern.Invalidation,
+	}
+	for _, index := range pattern.Pivots {
+		bar := stock.Data[index]
+		result.Pivots = append(result.Pivots, PatternPivot{bar.Date, index, bar.Low, bar.High})
+	}
+	return result
+}
+
+func newZoneResult(stock *StockData, zone Zone) ZoneResult {
+	return ZoneResult{
+		Type:           zone.Role,
+		Low:            zone.Low,
+		High:           zone.High,
+		Touches:        zone.Touches,
+		FirstTouchDate: stock.Data[zone.FirstTouch].Date,
+		LastTouchDate:  stock.Data[zone.LastTouch].Date,
+		Volume:         zone.Volume,
+		Strength:       zone.Strength,
+		Reversal:       zone.Reversal,
+	}
+}
+
+func newRuleOutput(result RuleResult) RuleOutput {
+	return RuleOutput{result.Rule.Text, result.Value, result.Known, result.Passed, result.Rule.Preferred, result.ToString()}
+}
+
+// describes the lines that make up the best setup
+func getSetupType(setup []Intersection, levelType string, numHorizontalLines int) string {
+	if *brokenToday && len(setup) > 0 {
+		return TREND_LINE_BREAK
+	}
+
+	types := make(map[string]bool)
+	for _, intersection := range setup {
+		types[intersection.Type] = true
+	}
+
+	setupType := ""
+	for _, lineType := range []string{TREND_LINE, TREND_CHANNEL_LINE} {
+		if types[lineType] {
+			if setupType != "" {
+				setupType += " + "
+			}
+			setupType += lineType
+		}
+	}
+	if numHorizontalLines > 0 {
+		if setupType != "" {
+			setupType += " + "
+		}
+		setupType += levelType
+	}
+	return setupType
+}
+
+// orders setups across all symbols and sides by descending score
+func rankResults(results []ScanResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	for i := range results {
+		results[i].Rank = i + 1
+	}
+}
+
+func renderTextOutput(results []ScanResult) (string, error) {
+	tmpl, err := template.New("output").Funcs(template.FuncMap{
+		"price": func(price float64) string {
+			return fmt.Sprintf("$%.2f", price)
+		},
+		"percent": func(fraction float64) float64 {
+			return fraction * 100
+		},
+		"join": strings.Join,
+		"title": func(text string) string {
+			if text == "" {
+				return text
+			}
+			return strings.ToUpper(text[:1]) + text[1:]
+		},
+	}).Parse(TEXT_OUTPUT_TEMPLATE)
+	if err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	for _, result := range results {
+		if err := tmpl.Execute(&output, result); err != nil {
+			return "", err
+		}
+	}
+	return output.String(), nil
+}
+
+// renders a table of the industry groups, strongest first, followed by the
+// results under their group's heading in rank order
+func renderGroupOutput(results []ScanResult, groups []*IndustryGroup) (string, error) {
+	output := "=============== Industry Groups ===============\n"
+	for _, group := range groups {
+		output += group.ToString() + "\n"
+	}
+	for _, group := range groups {
+		var members []ScanResult
+		for _, result := range results {
+			if result.Industry == group.Industry {
+				members = append(members, result)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		text, err := renderTextOutput(members)
+		if err != nil {
+			return "", err
+		}
+		output += fmt.Sprintf("############### %s ###############\n", group.Industry) + text
+	}
+	return output, nil
+}
+
+func writeJSONLines(filename string, results []ScanResult) error {
+	var output strings.Builder
+	encoder := json.NewEncoder(&output)
+	for _, result := range results {
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filename, []byte(output.String()), 0644)
+}
+
+// writes one row per line of every result. the section column tells apart the
+// best setup, all intersecting lines and horizontal support.
+func writeCSV(filename string, results []ScanResult) error {
+	var output strings.Builder
+	writer := csv.NewWriter(&output)
+	writer.Write([]string{"symbol", "date", "side", "setup_type", "rank", "score", "last_close", "rs_rating", "sector", "industry", "regime", "section", "line_type",
+		"start_date", "start_price", "start_index", "end_date", "end_price", "end_index", "slope", "slope_percent", "projection", "forward_price", "forward_date", "provisional", "confidence", "touches", "last_touch_date", "violations", "break", "reaction", "bar_patterns", "close_location"})
+
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	for _, result := range results {
+		sections := []struct {
+			Name  string
+			Lines []LineResult
+		}{{"best", result.BestSetup}, {"all", result.AllLines}, {"support", result.Support}, {"resistance", result.Resistance}}
+		for _, section := range sections {
+			for _, line := range section.Lines {
+				writer.Write([]string{result.Symbol, result.Date, result.Side, result.SetupType, strconv.Itoa(result.Rank), formatFloat(result.Score), formatFloat(result.LastClose), formatFloat(result.RSRating), result.Sector, result.Industry, result.Regime,
+					section.Name, line.Type, line.StartDate, formatFloat(line.StartPrice), strconv.Itoa(line.StartIndex),
+					line.EndDate, formatFloat(line.EndPrice), strconv.Itoa(line.EndIndex), formatFloat(line.Slope), formatFloat(line.SlopePercent), formatFloat(line.Projection), formatFloat(line.ForwardPrice), line.ForwardDate,
+					strconv.FormatBool(line.Provisional), formatFloat(line.Confidence), strconv.Itoa(line.Touches), line.LastTouchDate, strconv.Itoa(line.Violations),
+					line.Break, line.Reaction, strings.Join(line.BarPatterns, ";"), formatFloat(line.CloseLocation)})
+			}
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(output.String()), 0644)
+}
+
+func writeApproachCSV(filename string, approaching []ApproachResult) error {
+	var output strings.Builder
+	writer := csv.NewWriter(&output)
+	writer.Write([]string{"symbol", "date", "side", "last_close", "line_type", "start_date", "start_price", "end_date", "end_price",
+		"projection", "forward_price", "forward_date", "distance", "distance_atr", "distance_percent", "bars_to_contact"})
+
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	for _, approach := range approaching {
+		line := approach.Line
+		writer.Write([]string{approach.Symbol, approach.Date, approach.Side, formatFloat(approach.LastClose), line.Type, line.StartDate, formatFloat(line.StartPrice),
+			line.EndDate, formatFloat(line.EndPrice), formatFloat(line.Projection), formatFloat(line.ForwardPrice), line.ForwardDate,
+			formatFloat(approach.Distance), formatFloat(approach.DistanceATR), formatFloat(approach.DistancePercent), formatFloat(approach.BarsToContact)})
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(output.String()), 0644)
+}
+
+// renders a candlestick chart of the stock as an SVG document with the
+// analysis' pivots, trend lines, trend channel lines and support or
+// resistance. lines are drawn from their first anchor to the last bar and the
+// best setup's intersections with the last bar are circled. with -log-scale
+// the price axis is logarithmic so log-scale lines are drawn straight.
+func renderChart(stock *StockData, analysis *StockAnalysis) string {
+	data := stock.Data
+	if len(data) == 0 {
+		return ""
+	}
+
+	minPrice, maxPrice := math.MaxFloat64, -math.MaxFloat64
+	for _, bar := range data {
+		minPrice = math.Min(minPrice, bar.Low)
+		maxPrice = math.Max(maxPrice, bar.High)
+	}
+	if maxPrice == minPrice {
+		maxPrice = minPrice + 1
+	}
+	// log scale pads by a ratio so that the lower bound stays above zero
+	if *logScale {
+		padding := math.Pow(maxPrice/minPrice, 0.05)
+		minPrice, maxPrice = minPrice/padding, maxPrice*padding
+	} else {
+		padding := (maxPrice - minPrice) * 0.05
+		minPrice, maxPrice = minPrice-padding, maxPrice+padding
+	}
+
+	plotWidth := float64(CHART_WIDTH - 2*CHART_MARGIN)
+	plotHeight := float64(CHART_HEIGHT - 2*CHART_MARGIN)
+	barWidth := plotWidth / float64(len(data))
+	x := func(index int) float64 {
+		return float64(CHART_MARGIN) + (float64(index)+0.5)*barWidth
+	}
+	y := func(price float64) float64 {
+		if *logScale {
+			return float64(CHART_MARGIN) + math.Log(maxPrice/price)/math.Log(maxPrice/minPrice)*plotHeight
+		}
+		return float64(CHART_MARGIN) + (maxPrice-price)/(maxPrice-minPrice)*plotHeight
+	}
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"11\">\n", CHART_WIDTH, CHART_HEIGHT)
+	fmt.Fprintf(&svg, "<rect width=\"100%%\" height=\"100%%\" fill=\"white\"/>\n")
+	fmt.Fprintf(&svg, "<clipPath id=\"plot\"><rect x=\"%d\" y=\"%d\" width=\"%.1f\" height=\"%.1f\"/></clipPath>\n", CHART_MARGIN, CHART_MARGIN, plotWidth, plotHeight)
+	fmt.Fprintf(&svg, "<text x=\"%d\" y=\"%d\" font-size=\"16\">%s - %s</text>\n", CHART_MARGIN, CHART_MARGIN/2, stock.Symbol, data[len(data)-1].Date)
+
+	// price axis and date labels
+	for i := 0; i <= 5; i++ {
+		price := minPrice + (maxPrice-minPrice)*float64(i)/5
+		if *logScale {
+			price = minPrice * math.Pow(maxPrice/minPrice, float64(i)/5)
+		}
+		fmt.Fprintf(&svg, "<line x1=\"%d\" y1=\"%.1f\" x2=\"%d\" y2=\"%.1f\" stroke=\"#eeeeee\"/>\n", CHART_MARGIN, y(price), CHART_WIDTH-CHART_MARGIN, y(price))
+		fmt.Fprintf(&svg, "<text x=\"%d\" y=\"%.1f\">$%.2f</text>\n", CHART_WIDTH-CHART_MARGIN+5, y(price)+4, price)
+	}
+	for i := 0; i < len(data); i += CHART_LABEL_SPACING {
+		fmt.Fprintf(&svg, "<text x=\"%.1f\" y=\"%d\" text-anchor=\"middle\">%s</text>\n", x(i), CHART_HEIGHT-CHART_MARGIN+15, data[i].Date)
+	}
+
+	// candlesticks
+	for i, bar := range data {
+		color := "#26a69a"
+		if bar.Close < bar.Open {
+			color = "#ef5350"
+		}
+		top, bottom := math.Max(bar.Open, bar.Close), math.Min(bar.Open, bar.Close)
+		fmt.Fprintf(&svg, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"%s\"/>\n", x(i), y(bar.High), x(i), y(bar.Low), color)
+		fmt.Fprintf(&svg, "<rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" fill=\"%s\"/>\n",
+			x(i)-barWidth*0.35, y(top), barWidth*0.7, math.Max(y(bottom)-y(top), 0.5), color)
+	}
+
+	// lines from the first anchor to the last bar
+	lastBarIndex := len(data) - 1
+	drawLines := func(lines []Line, color, dash string) {
+		for _, line := range lines {
+			fmt.Fprintf(&svg, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"%s\" stroke-dasharray=\"%s\" clip-path=\"url(#plot)\"/>\n",
+				x(line.X1), y(line.Y1), x(lastBarIndex), y(line.GetProjection(data[lastBarIndex].Session)), color, dash)
+		}
+	}
+	drawLines(analysis.TrendLines, "#2e7d32", "none")
+	drawLines(analysis.TrendChannelLines, "#ef6c00", "none")
+	drawLines(analysis.HorizontalLines, "#1565c0", "6,4")
+
+	// pivots below the lows, or above the highs when scanning the short side
+	// provisional pivots are drawn hollow
+	for _, pivot := range append(append([]Pivot{}, analysis.StartPivots...), analysis.Pivots...) {
+		pivotY := y(data[pivot.Index].Low) + 6
+		if analysis.Side == SHORT_SIDE {
+			pivotY = y(data[pivot.Index].High) - 6
+		}
+		fill := "#6a1b9a"
+		if pivot.Provisional {
+			fill = "none"
+		}
+		fmt.Fprintf(&svg, "<circle cx=\"%.1f\" cy=\"%.1f\" r=\"3\" fill=\"%s\" stroke=\"#6a1b9a\"/>\n", x(pivot.Index), pivotY, fill)
+	}
+
+	// best setup lines and their intersections with the last bar
+	for _, intersection := range analysis.Setup {
+		line := intersection.Line
+		fmt.Fprintf(&svg, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"black\" stroke-width=\"2\" clip-path=\"url(#plot)\"/>\n",
+			x(line.X1), y(line.Y1), x(lastBarIndex), y(intersection.Price))
+		fmt.Fprintf(&svg, "<circle cx=\"%.1f\" cy=\"%.1f\" r=\"6\" fill=\"none\" stroke=\"#d50000\" stroke-width=\"2\"/>\n", x(lastBarIndex), y(intersection.Price))
+	}
+
+	// legend
+	legend := []struct {
+		Name  string
+		Color string
+	}{{TREND_LINE, "#2e7d32"}, {TREND_CHANNEL_LINE, "#ef6c00"}, {analysis.GetLevelType(), "#1565c0"}, {"Pivot", "#6a1b9a"}, {"Intersection", "#d50000"}}
+	for i, item := range legend {
+		legendX := CHART_MARGIN + 200 + i*140
+		fmt.Fprintf(&svg, "<rect x=\"%d\" y=\"%d\" width=\"10\" height=\"10\" fill=\"%s\"/>\n", legendX, CHART_MARGIN/2-9, item.Color)
+		fmt.Fprintf(&svg, "<text x=\"%d\" y=\"%d\">%s</text>\n", legendX+14, CHART_MARGIN/2, item.Name)
+	}
+
+	svg.WriteString("</svg>\n")
+	return svg.String()
+}
+
+type ScoreWeights struct {
+	Touches       float64 `json:"touches"`
+	Age           float64 `json:"age"`
+	Length        float64 `json:"length"`
+	Slope         float64 `json:"slope"`
+	Confluence    float64 `json:"confluence"`
+	Support       float64 `json:"support"`
+	Volume        float64 `json:"volume"`
+	CloseLocation float64 `json:"close_location"`
+	Reaction      float64 `json:"reaction"`
+	RSRating      float64 `json:"rs_rating"`
+}
+
+type SetupScore struct {
+	Total      float64
+	Components map[string]float64
+}
+
+// reads score weights from a JSON object. weights missing from the file keep
+// their DEFAULT_SCORE_WEIGHTS value.
+func loadScoreWeights(filename string) (ScoreWeights, error) {
+	weights := DEFAULT_SCORE_WEIGHTS
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return weights, err
+	}
+	if err := json.Unmarshal(raw, &weights); err != nil {
+		return weights, fmt.Errorf("%s: %v", filename, err)
+	}
+	return weights, nil
+}
+
+// scores a candidate setup from 0 to 100. every component is normalized to
+// [0, 1] and the total is their weighted average:
+//   - touches: pivots within the line tolerance band of each line
+//   - age: bars since each line's first anchor, relative to the data length
+//   - length: bars between each line's anchors, relative to the data length
+//   - slope: flatter lines score higher, zero at MAX_SLOPE_ATR_PER_BAR
+//   - confluence: distance between the lines' projections in ATRs
+//   - support: distance from the projections to the nearest horizontal level
+//   - volume: last bar volume relative to the average, capped at MAX_VOLUME_RATIO
+//   - close location: where the last bar closed within its range, in the
+//     direction of the setup
+//   - reaction: 1 for a reversal bar at each line, 0.5 for a hold and 0 for a
+//     close through the line
+//   - rs rating: the symbol's RS rating, inverted for short setups. symbols
+//     without a rating are scored on the other components alone.
+func scoreSetup(stock *StockData, analysis *StockAnalysis, setup []Intersection, weights ScoreWeights) SetupScore {
+	data := stock.Data
+	lastBarIndex := len(data) - 1
+	lastBar := data[lastBarIndex]
+	atr := getCurrentATR(stock)
+	getHighLines := analysis.Side == SHORT_SIDE
+
+	touches, age, length, slope, reaction := 0.0, 0.0, 0.0, 0.0, 0.0
+	for _, intersection := range setup {
+		switch intersection.Reaction {
+		case REACTION_REVERSAL:
+			reaction += 1
+		case REACTION_HOLD:
+			reaction += 0.5
+		}
+		line := intersection.Line
+		touches += math.Min(float64(line.Touches), float64(MAX_TOUCHES)) / float64(MAX_TOUCHES)
+		age += float64(lastBarIndex-line.X1) / float64(len(data))
+		length += float64(line.X2-line.X1) / float64(len(data))
+		slope += math.Max(0, 1-math.Abs(line.PriceSlope(lastBar.Session))/atr/MAX_SLOPE_ATR_PER_BAR)
+	}
+	numLines := float64(len(setup))
+
+	confluence := 0.0
+	if len(setup) == 2 {
+		distance, _ := getPairRange(setup[0], setup[1])
+		confluence = math.Max(0, 1-distance/atr/CONFLUENCE_ATR_MULTIPLE)
+	}
+
+	support := 0.0
+	for _, intersection := range setup {
+		for _, level := range analysis.HorizontalLines {
+			distance := math.Abs(intersection.Price - level.Y1)
+			support = math.Max(support, 1-distance/atr/SUPPORT_ATR_MULTIPLE)
+		}
+	}
+
+	volume := 0.0
+	averageVolume := getAverageVolume(stock, FILTER_LOOKBACK)
+	if averageVolume > 0 {
+		volume = math.Min(float64(lastBar.Volume)/averageVolume, MAX_VOLUME_RATIO) / MAX_VOLUME_RATIO
+	}
+
+	closeLocation := getCloseLocation(lastBar)
+	if getHighLines {
+		closeLocation = 1 - closeLocation
+	}
+
+	components := map[string]float64{
+		"touches":        touches / numLines,
+		"age":            age / numLines,
+		"length":         length / numLines,
+		"slope":          slope / numLines,
+		"confluence":     confluence,
+		"support":        support,
+		"volume":         volume,
+		"close_location": closeLocation,
+		"reaction":       reaction / numLines,
+	}
+	componentWeights := map[string]float64{
+		"touches":        weights.Touches,
+		"age":            weights.Age,
+		"length":         weights.Length,
+		"slope":          weights.Slope,
+		"confluence":     weights.Confluence,
+		"support":        weights.Support,
+		"volume":         weights.Volume,
+		"close_location": weights.CloseLocation,
+		"reaction":       weights.Reaction,
+		"rs_rating":      weights.RSRating,
+	}
+	if rating, ok := rsRatings[stock.Symbol]; ok {
+		strength := (rating - 1) / 98
 		if getHighLines {
-			if line.Slope() > 0 { //HORIZONTAL_SLOPE_THRESHOLD {
-				trendChannelLines = append(trendChannelLines, line)
-			} else { //if line.Slope() < -HORIZONTAL_SLOPE_THRESHOLD {
-				trendLines = append(trendLines, line)
-			} 
-			// else {
-			// 	horizontalLines = append(horizontalLines, line)
-			// }
+			strength = 1 - strength
+		}
+		components["rs_rating"] = strength
+	}
+
+	total, totalWeight := 0.0, 0.0
+	for name, value := range components {
+		total += value * componentWeights[name]
+		totalWeight += componentWeights[name]
+	}
+	if totalWeight > 0 {
+		total = total / totalWeight * 100
+	}
+
+	return SetupScore{total, components}
+}
+
+// counts the pivots from the line's start whose low (or high) lies within the
+// tolerance band of the line and returns the index of the latest one
+func countTouches(stock *StockData, line *Line, pivots []Pivot, getHighPivots bool) (int, int) {
+	touches, lastTouch := 0, line.X1
+	counted := make(map[int]bool)
+	for _, pivot := range pivots {
+		if pivot.Index < line.X1 || counted[pivot.Index] {
+			continue
+		}
+		price := stock.Data[pivot.Index].Low
+		if getHighPivots {
+			price = stock.Data[pivot.Index].High
+		}
+		projection := line.GetProjection(stock.Data[pivot.Index].Session)
+		if math.Abs(price-projection) <= getLineTolerance(stock, pivot.Index, projection) {
+			counted[pivot.Index] = true
+			touches++
+			if pivot.Index > lastTouch {
+				lastTouch = pivot.Index
+			}
+		}
+	}
+	return touches, lastTouch
+}
+
+// returns the half-width of the band around a line at the given bar, in ATRs
+// or as a fraction of the line's price
+func getLineTolerance(stock *StockData, index int, price float64) float64 {
+	if *toleranceType == PERCENT_TOLERANCE {
+		return *tolerancePercent * price
+	}
+	atr := stock.Data[index].ATR
+	if atr <= 0 {
+		atr = getCurrentATR(stock)
+	}
+	return *toleranceATR * atr
+}
+
+// returns the last bar's ATR, or the average bar range when there are not
+// yet ATR_WINDOW bars
+func getCurrentATR(stock *StockData) float64 {
+	data := stock.Data
+	if atr := data[len(data)-1].ATR; atr > 0 {
+		return atr
+	}
+	sum := 0.0
+	for _, bar := range data {
+		sum += bar.High - bar.Low
+	}
+	if sum <= 0 {
+		return 1
+	}
+	return sum / float64(len(data))
+}
+
+func getAverageVolume(stock *StockData, lookback int) float64 {
+	data := stock.Data
+	start := len(data) - lookback
+	if start < 0 {
+		start = 0
+	}
+	if start == len(data) {
+		return 0
+	}
+
+	sum := 0.0
+	for _, bar := range data[start:] {
+		sum += float64(bar.Volume)
+	}
+	return sum / float64(len(data)-start)
+}
+
+// returns where the bar closed within its range, from 0 at the low to 1 at
+// the high
+func getCloseLocation(bar StockBar) float64 {
+	if bar.High == bar.Low {
+		return 0.5
+	}
+	return (bar.Close - bar.Low) / (bar.High - bar.Low)
+}
+
+// StudyEvent is a setup that would have fired on a past bar together with
+// what price did afterwards. returns and excursions are fractions of the entry
+// close, signed so that positive is in the setup's favor. Delisted events have
+// horizons measured at the final close of a delisted symbol.
+type StudyEvent struct {
+	Symbol     string
+	Date       string
+	Side       string
+	SetupType  string
+	Score      float64
+	Regime     string
+	EntryPrice float64
+	Returns    []float64
+	Known      []bool
+	Measured   bool
+	MFE        float64
+	MAE        float64
+	Delisted   bool
+}
+
+type StudyStats struct {
+	Count         int
+	Hits          []int
+	Totals        []float64
+	Counts        []int
+	MeasuredCount int
+	MFE           float64
+	MAE           float64
+}
+
+func parseHorizons(text string) ([]int, error) {
+	var horizons []int
+	for _, field := range strings.Split(text, ",") {
+		horizon, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || horizon <= 0 {
+			return nil, fmt.Errorf("invalid horizon: %q", field)
+		}
+		horizons = append(horizons, horizon)
+	}
+	return horizons, nil
+}
+
+// replays the stock bar by bar. at every bar the pre-filters and the line
+// analysis only see the bars up to and including it, and every setup that
+// fires is measured against the bars that follow. with a membership only the
+// bars the symbol was a member on are replayed, and when the data runs up to
+// its delisting, horizons past the final bar are measured at the final close.
+func studyStock(stock *StockData, member *Membership, sides []string, horizons []int, filters []TechnicalFilter, regime *MarketRegime) []StudyEvent {
+	var events []StudyEvent
+	data := stock.Data
+	final := false
+	if member != nil && member.Delisted != "" {
+		for i := range data {
+			if data[i].Date >= member.Delisted {
+				data = data[:i]
+				break
+			}
+		}
+		delisted, _ := time.Parse(TIME_LAYOUT, member.Delisted)
+		final = len(data) > 0 && !tradingCalendar.AddSessions(data[len(data)-1].Time, 1).Before(delisted)
+	}
+	maxHorizon := 0
+	for _, horizon := range horizons {
+		if horizon > maxHorizon {
+			maxHorizon = horizon
+		}
+	}
+
+	cache := &PivotCache{Stock: stock, Pivots: make(map[PivotKey][]Pivot)}
+	for t := STUDY_MIN_BARS; t < len(data); t++ {
+		if member != nil && !member.Contains(data[t].Date) {
+			continue
+		}
+		history := StockData{Data: data[:t+1], Symbol: stock.Symbol, Timeframe: stock.Timeframe, PivotCache: cache}
+		if _, ok := applyTechnicalFilters(&history, filters); !ok {
+			continue
+		}
+
+		for _, side := range sides {
+			analysis, ok := analyzeStock(&history, side)
+			if !ok {
+				continue
+			}
+
+			regimeLabel := UNKNOWN_REGIME
+			if regime != nil {
+				_, regimeLabel = regime.GetStockRegime(&history)
+				if *regimeMode == REGIME_SUPPRESS && isAgainstRegime(side, regimeLabel) {
+					continue
+				}
+			}
+
+			event := StudyEvent{
+				Symbol:     stock.Symbol,
+				Date:       data[t].Date,
+				Side:       side,
+				SetupType:  getSetupType(analysis.Setup, analysis.GetLevelType(), len(analysis.HorizontalLines)),
+				Score:      analysis.Score.Total,
+				Regime:     regimeLabel,
+				EntryPrice: data[t].Close,
+				Returns:    make([]float64, len(horizons)),
+				Known:      make([]bool, len(horizons)),
+			}
+			direction := 1.0
+			if side == SHORT_SIDE {
+				direction = -1.0
+			}
+
+			for h, horizon := range horizons {
+				if t+horizon < len(data) {
+					event.Returns[h] = direction * (data[t+horizon].Close/event.EntryPrice - 1)
+					event.Known[h] = true
+				} else if final {
+					event.Returns[h] = direction * (data[len(data)-1].Close/event.EntryPrice - 1)
+					event.Known[h] = true
+					event.Delisted = true
+				}
+			}
+			for j := t + 1; j <= t+maxHorizon && j < len(data); j++ {
+				favorable, adverse := data[j].High/event.EntryPrice-1, data[j].Low/event.EntryPrice-1
+				if side == SHORT_SIDE {
+					favorable, adverse = 1-data[j].Low/event.EntryPrice, 1-data[j].High/event.EntryPrice
+				}
+				event.MFE = math.Max(event.MFE, favorable)
+				event.MAE = math.Min(event.MAE, adverse)
+				event.Measured = true
+			}
+
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+func (s *StudyStats) Add(event *StudyEvent) {
+	if s.Hits == nil {
+		s.Hits = make([]int, len(event.Returns))
+		s.Totals = make([]float64, len(event.Returns))
+		s.Counts = make([]int, len(event.Returns))
+	}
+	s.Count++
+	if event.Measured {
+		s.MeasuredCount++
+		s.MFE += event.MFE
+		s.MAE += event.MAE
+	}
+	for h, ret := range event.Returns {
+		if !event.Known[h] {
+			continue
+		}
+		s.Counts[h]++
+		s.Totals[h] += ret
+		if ret > 0 {
+			s.Hits[h]++
+		}
+	}
+}
+
+func (s *StudyStats) ToString(name string, horizons []int) string {
+	str := fmt.Sprintf("----- %s -----\n", name)
+	if s.MeasuredCount == 0 {
+		str += fmt.Sprintf("Setups: %d\n", s.Count)
+	} else {
+		str += fmt.Sprintf("Setups: %d - Avg MFE: %.2f%% - Avg MAE: %.2f%%\n", s.Count, s.MFE/float64(s.MeasuredCount)*100, s.MAE/float64(s.MeasuredCount)*100)
+	}
+	for h, horizon := range horizons {
+		if s.Counts[h] == 0 {
+			str += fmt.Sprintf("%d bars - no data\n", horizon)
+			continue
+		}
+		str += fmt.Sprintf("%d bars - Avg Return: %.2f%% - Hit Rate: %.1f%% (%d)\n",
+			horizon, s.Totals[h]/float64(s.Counts[h])*100, float64(s.Hits[h])/float64(s.Counts[h])*100, s.Counts[h])
+	}
+	return str
+}
+
+// aggregates study events across the universe by side and setup type, and by
+// market regime when one is loaded
+func getStudyReport(events []StudyEvent, horizons []int, byRegime bool) string {
+	total := StudyStats{}
+	bySetup := make(map[string]*StudyStats)
+	regimes := make(map[string]*StudyStats)
+	for i := range events {
+		event := &events[i]
+		total.Add(event)
+
+		key := fmt.Sprintf("%s - %s", event.Side, event.SetupType)
+		if _, ok := bySetup[key]; !ok {
+			bySetup[key] = &StudyStats{}
+		}
+		bySetup[key].Add(event)
+
+		if _, ok := regimes[event.Regime]; !ok {
+			regimes[event.Regime] = &StudyStats{}
+		}
+		regimes[event.Regime].Add(event)
+	}
+
+	report := "=============== Signal Study ===============\n"
+	if total.Count == 0 {
+		return report + "No setups fired.\n"
+	}
+	report += total.ToString("All Setups", horizons)
+
+	report += "=============== By Setup Type ===============\n"
+	var keys []string
+	for key := range bySetup {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		report += bySetup[key].ToString(key, horizons)
+	}
+
+	if byRegime {
+		report += "=============== By Market Regime ===============\n"
+		for _, label := range []string{UPTREND, MIXED, DOWNTREND, UNKNOWN_REGIME} {
+			if stats, ok := regimes[label]; ok {
+				report += stats.ToString(label, horizons)
+			}
+		}
+	}
+
+	return report
+}
+
+func writeStudyEvents(filename string, events []StudyEvent, horizons []int) error {
+	var output strings.Builder
+	writer := csv.NewWriter(&output)
+
+	header := []string{"symbol", "date", "side", "setup_type", "score", "regime", "entry_price"}
+	for _, horizon := range horizons {
+		header = append(header, fmt.Sprintf("return_%d", horizon))
+	}
+	writer.Write(append(header, "mfe", "mae", "delisted"))
+
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	for _, event := range events {
+		row := []string{event.Symbol, event.Date, event.Side, event.SetupType, formatFloat(event.Score), event.Regime, formatFloat(event.EntryPrice)}
+		for h := range horizons {
+			if event.Known[h] {
+				row = append(row, formatFloat(event.Returns[h]))
+			} else {
+				row = append(row, "")
+			}
+		}
+		if event.Measured {
+			row = append(row, formatFloat(event.MFE), formatFloat(event.MAE))
+		} else {
+			row = append(row, "", "")
+		}
+		writer.Write(append(row, strconv.FormatBool(event.Delisted)))
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(output.String()), 0644)
+}
+
+// Watchlist is the persistent record of the setups the scanner emits. History
+// holds the entry keys emitted on every scan date, so the lists of two dates
+// can be compared.
+type Watchlist struct {
+	Entries []*WatchlistEntry   `json:"entries"`
+	History map[string][]string `json:"history"`
+}
+
+// WatchlistEntry is one symbol and side on the watchlist. the trigger and
+// invalidation prices come from the latest setup the scanner emitted for it,
+// on the bar dated SignalDate.
+type WatchlistEntry struct {
+	Symbol            string  `json:"symbol"`
+	Side              string  `json:"side"`
+	SetupType         string  `json:"setup_type,omitempty"`
+	Manual            bool    `json:"manual,omitempty"`
+	FirstSeen         string  `json:"first_seen"`
+	LastSeen          string  `json:"last_seen"`
+	Scans             int     `json:"scans"`
+	SignalDate        string  `json:"signal_date,omitempty"`
+	TriggerPrice      float64 `json:"trigger_price,omitempty"`
+	InvalidationPrice float64 `json:"invalidation_price,omitempty"`
+	Status            string  `json:"status"`
+	StatusDate        string  `json:"status_date,omitempty"`
+}
+
+func (e *WatchlistEntry) Key() string {
+	return getWatchlistKey(e.Symbol, e.Side)
+}
+
+func (e *WatchlistEntry) ToString() string {
+	str := e.Symbol
+	if e.Side == SHORT_SIDE {
+		str += " (Short)"
+	}
+	if e.SetupType != "" {
+		str += " - " + e.SetupType
+	}
+	str += " - " + strings.ToUpper(e.Status[:1]) + e.Status[1:]
+	if e.StatusDate != "" {
+		str += " on " + e.StatusDate
+	}
+	if e.Manual {
+		str += " - Added manually on " + e.FirstSeen
+	} else {
+		str += fmt.Sprintf(" - On list since %s (%d sessions, %d scans)", e.FirstSeen, e.GetSessions(), e.Scans)
+	}
+	if e.TriggerPrice > 0 {
+		str += fmt.Sprintf(" - Trigger $%.2f - Invalidation $%.2f", e.TriggerPrice, e.InvalidationPrice)
+	}
+	return str
+}
+
+// returns the number of trading sessions from the entry's first to its last
+// appearance, both included
+func (e *WatchlistEntry) GetSessions() int {
+	first, firstErr := time.Parse(TIME_LAYOUT, e.FirstSeen)
+	last, lastErr := time.Parse(TIME_LAYOUT, e.LastSeen)
+	if firstErr != nil || lastErr != nil {
+		return 0
+	}
+	return tradingCalendar.CountSessions(first, last) + 1
+}
+
+func getWatchlistKey(symbol, side string) string {
+	return strings.ToUpper(symbol) + ":" + side
+}
+
+// formats an entry key the way the reports name setups, e.g. "AAPL (Short)"
+func formatWatchlistKey(key string) string {
+	symbol, side := key, LONG_SIDE
+	if i := strings.LastIndex(key, ":"); i >= 0 {
+		symbol, side = key[:i], key[i+1:]
+	}
+	if side == SHORT_SIDE {
+		return symbol + " (Short)"
+	}
+	return symbol
+}
+
+func (w *Watchlist) Find(symbol, side string) *WatchlistEntry {
+	key := getWatchlistKey(symbol, side)
+	for _, entry := range w.Entries {
+		if entry.Key() == key {
+			return entry
+		}
+	}
+	return nil
+}
+
+// adds an entry by hand. it is active until removed and is not part of any
+// scan date's list.
+func (w *Watchlist) Add(symbol, side, date string) (*WatchlistEntry, bool) {
+	if entry := w.Find(symbol, side); entry != nil {
+		return entry, false
+	}
+	entry := &WatchlistEntry{Symbol: strings.ToUpper(symbol), Side: side, Manual: true, FirstSeen: date, LastSeen: date, Status: WATCH_ACTIVE}
+	w.Entries = append(w.Entries, entry)
+	return entry, true
+}
+
+func (w *Watchlist) Remove(symbol, side string) bool {
+	key := getWatchlistKey(symbol, side)
+	for i, entry := range w.Entries {
+		if entry.Key() == key {
+			w.Entries = append(w.Entries[:i], w.Entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// clears the list of a scan date so that rerunning a scan replaces it
+func (w *Watchlist) StartScan(date string) {
+	w.History[date] = nil
+}
+
+// records a setup the scanner emitted on a scan date. a long setup triggers
+// on a close above the signal bar's high and is invalidated by a close below
+// its lowest setup line or support level; a short setup the other way around.
+// a setup emitted again replaces the levels of the previous one and makes the
+// entry active again.
+func (w *Watchlist) Record(date string, stock *StockData, result *ScanResult) {
+	entry := w.Find(result.Symbol, result.Side)
+	if entry == nil {
+		entry = &WatchlistEntry{Symbol: strings.ToUpper(result.Symbol), Side: result.Side, FirstSeen: date}
+		w.Entries = append(w.Entries, entry)
+	}
+	key := entry.Key()
+	if w.IsListed(date, key) {
+		return
+	}
+	w.History[date] = append(w.History[date], key)
+
+	lastBar := stock.Data[len(stock.Data)-1]
+	levels := []float64{lastBar.Low}
+	entry.TriggerPrice = lastBar.High
+	if result.Side == SHORT_SIDE {
+		levels = []float64{lastBar.High}
+		entry.TriggerPrice = lastBar.Low
+	}
+	for _, line := range result.BestSetup {
+		levels = append(levels, line.Projection)
+	}
+	for _, level := range append(result.Support, result.Resistance...) {
+		levels = append(levels, level.StartPrice)
+	}
+	sort.Float64s(levels)
+	entry.InvalidationPrice = levels[0]
+	if result.Side == SHORT_SIDE {
+		entry.InvalidationPrice = levels[len(levels)-1]
+	}
+
+	// an entry missing from the previous scan date's list starts a new
+	// stretch on the list
+	if entry.LastSeen != date {
+		if !w.IsListed(w.GetPreviousDate(date), key) {
+			entry.FirstSeen, entry.Scans = date, 0
+		}
+		entry.Scans++
+	}
+	entry.LastSeen = date
+	entry.SetupType = result.SetupType
+	entry.SignalDate = lastBar.Date
+	entry.Status = WATCH_ACTIVE
+	entry.StatusDate = ""
+	entry.Manual = false
+}
+
+// checks the stock's bars after each active entry's signal bar for the first
+// close that triggers or invalidates the setup
+func (w *Watchlist) Update(stock *StockData) {
+	for _, entry := range w.Entries {
+		if entry.Status != WATCH_ACTIVE || entry.SignalDate == "" || entry.Symbol != strings.ToUpper(stock.Symbol) {
+			continue
+		}
+		for _, bar := range stock.Data {
+			if bar.Date <= entry.SignalDate {
+				continue
+			}
+			triggered := bar.Close > entry.TriggerPrice
+			invalidated := bar.Close < entry.InvalidationPrice
+			if entry.Side == SHORT_SIDE {
+				triggered = bar.Close < entry.TriggerPrice
+				invalidated = bar.Close > entry.InvalidationPrice
+			}
+			if triggered {
+				entry.Status, entry.StatusDate = WATCH_TRIGGERED, bar.Date
+				break
+			}
+			if invalidated {
+				entry.Status, entry.StatusDate = WATCH_INVALIDATED, bar.Date
+				break
+			}
+		}
+	}
+}
+
+// returns the scan dates in the history, oldest first
+func (w *Watchlist) GetDates() []string {
+	var dates []string
+	for date := range w.History {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	return dates
+}
+
+// returns the latest scan date before date, empty when there is none
+func (w *Watchlist) GetPreviousDate(date string) string {
+	previous := ""
+	for _, scanDate := range w.GetDates() {
+		if scanDate < date {
+			previous = scanDate
+		}
+	}
+	return previous
+}
+
+func (w *Watchlist) IsListed(date, key string) bool {
+	for _, listed := range w.History[date] {
+		if listed == key {
+			return true
+		}
+	}
+	return false
+}
+
+// compares a scan date's list with the previous scan date's: entries that
+// are new, dropped or on both lists
+func (w *Watchlist) Diff(date string) ([]string, []string, []string) {
+	previous := w.GetPreviousDate(date)
+	current := make(map[string]bool)
+	for _, key := range w.History[date] {
+		current[key] = true
+	}
+	before := make(map[string]bool)
+	for _, key := range w.History[previous] {
+		before[key] = true
+	}
+
+	var added, dropped, persisting []string
+	for _, key := range w.History[date] {
+		if before[key] {
+			persisting = append(persisting, formatWatchlistKey(key))
 		} else {
-			if line.Slope() >= 0 { // HORIZONTAL_SLOPE_THRESHOLD {
-				trendLines = append(trendLines, line)
-			} else { // } if line.Slope() < 0 { //-HORIZONTAL_SLOPE_THRESHOLD {
-				trendChannelLines = append(trendChannelLines, line)
-			} 
-			// else {
-			// 	horizontalLines = append(horizontalLines, line)
-			// }
+			added = append(added, formatWatchlistKey(key))
+		}
+	}
+	for _, key := range w.History[previous] {
+		if !current[key] {
+			dropped = append(dropped, formatWatchlistKey(key))
 		}
 	}
+	sort.Strings(added)
+	sort.Strings(dropped)
+	sort.Strings(persisting)
+	return added, dropped, persisting
+}
 
-	return trendChannelLines, trendLines, horizontalLines
+func (w *Watchlist) DiffToString(date string) string {
+	added, dropped, persisting := w.Diff(date)
+	str := fmt.Sprintf("New (%d): %s\n", len(added), strings.Join(added, ", "))
+	str += fmt.Sprintf("Dropped (%d): %s\n", len(dropped), strings.Join(dropped, ", "))
+	str += fmt.Sprintf("Persisting (%d): %s\n", len(persisting), strings.Join(persisting, ", "))
+	return str
 }
 
-func getSupport(stock *StockData) ([]Line) {
-	var support []Line
-	pivots := getPivots(stock, false, SUPPORT_PIVOT_WIDTH)
-	for _, pivot := range pivots {
-		supportLow := stock.Data[pivot].Low
-		currentIndex := len(stock.Data) - 1
-		currentHigh := stock.Data[currentIndex].High
-		currentLow := stock.Data[currentIndex].Low
-		if supportLow > currentLow * (1 - SUPPORT_RANGE_PERCENT) && supportLow < currentHigh * (1 + SUPPORT_RANGE_PERCENT) {
-			support = append(support, Line{pivot, supportLow, currentIndex, supportLow})
+// reads the watchlist store. a store that does not exist yet is empty.
+func loadWatchlist(filename string) (*Watchlist, error) {
+	watchlist := &Watchlist{History: make(map[string][]string)}
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return watchlist, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, watchlist); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if watchlist.History == nil {
+		watchlist.History = make(map[string][]string)
+	}
+	return watchlist, nil
+}
+
+func saveWatchlist(filename string, watchlist *Watchlist) error {
+	raw, err := json.MarshalIndent(watchlist, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(raw, '\n'), 0644)
+}
+
+// writes the entries as CSV when the file name ends in .csv and as one symbol
+// per line otherwise, the format of OUTPUT_SYMBOLS_FILE
+func exportWatchlist(filename string, watchlist *Watchlist) error {
+	if !strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		symbols := ""
+		listed := make(map[string]bool)
+		for _, entry := range watchlist.Entries {
+			if !listed[entry.Symbol] {
+				listed[entry.Symbol] = true
+				symbols += entry.Symbol + "\n"
+			}
 		}
+		return ioutil.WriteFile(filename, []byte(symbols), 0644)
 	}
-	return support
+
+	var output strings.Builder
+	writer := csv.NewWriter(&output)
+	writer.Write([]string{"symbol", "side", "setup_type", "status", "status_date", "first_seen", "last_seen", "sessions", "scans", "signal_date", "trigger_price", "invalidation_price", "manual"})
+
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	for _, entry := range watchlist.Entries {
+		writer.Write([]string{entry.Symbol, entry.Side, entry.SetupType, entry.Status, entry.StatusDate, entry.FirstSeen, entry.LastSeen,
+			strconv.Itoa(entry.GetSessions()), strconv.Itoa(entry.Scans), entry.SignalDate, formatFloat(entry.TriggerPrice), formatFloat(entry.InvalidationPrice), strconv.FormatBool(entry.Manual)})
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(output.String()), 0644)
 }
 
-func getStartPivots(stock *StockData, getHighPivots bool) []int {
-	return getPivots(stock, getHighPivots, START_PIVOT_WIDTH)
+// runs a watchlist command against the store:
+//
+//	watchlist list [active|triggered|invalidated]
+//	watchlist add <symbol> [long|short]
+//	watchlist remove <symbol> [long|short]
+//	watchlist export [file]
+//	watchlist diff [date]
+func runWatchlistCommand(filename string, args []string, t time.Time) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: watchlist list|add|remove|export|diff")
+	}
+	if filename == "" {
+		return fmt.Errorf("no watchlist store, see -watchlist")
+	}
+	today := t.Format(TIME_LAYOUT)
+	watchlist, err := loadWatchlist(filename)
+	if err != nil {
+		return err
+	}
+	getSide := func(args []string) (string, error) {
+		if len(args) < 2 || args[1] == LONG_SIDE {
+			return LONG_SIDE, nil
+		} else if args[1] == SHORT_SIDE {
+			return SHORT_SIDE, nil
+		}
+		return "", fmt.Errorf("unknown side: %s", args[1])
+	}
+
+	switch args[0] {
+	case "list":
+		sorted := append([]*WatchlistEntry(nil), watchlist.Entries...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].FirstSeen < sorted[j].FirstSeen
+		})
+		for _, entry := range sorted {
+			if len(args) < 2 || entry.Status == args[1] {
+				fmt.Println(entry.ToString())
+			}
+		}
+		return nil
+	case "add", "remove":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: watchlist %s <symbol> [long|short]", args[0])
+		}
+		side, err := getSide(args[1:])
+		if err != nil {
+			return err
+		}
+		if args[0] == "add" {
+			entry, added := watchlist.Add(args[1], side, today)
+			if !added {
+				return fmt.Errorf("%s is already on the watchlist", formatWatchlistKey(entry.Key()))
+			}
+		} else if !watchlist.Remove(args[1], side) {
+			return fmt.Errorf("%s is not on the watchlist", formatWatchlistKey(getWatchlistKey(args[1], side)))
+		}
+		return saveWatchlist(filename, watchlist)
+	case "export":
+		exportFile := fmt.Sprintf(OUTPUT_WATCHLIST_FILE, t.Format("01-02-2006"))
+		if len(args) > 1 {
+			exportFile = args[1]
+		}
+		return exportWatchlist(exportFile, watchlist)
+	case "diff":
+		dates := watchlist.GetDates()
+		if len(dates) == 0 {
+			return fmt.Errorf("no scans recorded in %s", filename)
+		}
+		date := dates[len(dates)-1]
+		if len(args) > 1 {
+			date = args[1]
+		}
+		fmt.Print(watchlist.DiffToString(date))
+		return nil
+	}
+	return fmt.Errorf("unknown watchlist command: %s", args[0])
 }
 
-func getPivots(stock *StockData, getHighPivots bool, width int) []int {
-	var pivots []int
-	data := stock.Data
+type SymbolChange struct {
+	Symbol    string
+	Event     string
+	Date      string
+	NewSymbol string
+}
 
-	for i := width; i < len(data)-width; i++ {
-		isPivot := true
-		for j := i - width; j <= i+width; j++ {
-			if getHighPivots {
-				if data[j].High > data[i].High {
-					isPivot = false
-					break
+// Universe is a list of symbols to scan after cleaning: duplicates and
+// malformed symbols are dropped, and symbols delisted as of AsOf are removed
+// while renamed ones are replaced by their new symbol. Unknown symbols are
+// missing from the symbol metadata but are still scanned.
+type Universe struct {
+	Name       string
+	File       string
+	AsOf       string
+	Symbols    []string
+	Duplicates []string
+	Invalid    []string
+	Unknown    []string
+	Delisted   []SymbolChange
+	Renamed    []SymbolChange
+}
+
+var symbolPattern = regexp.MustCompile(`^[A-Z][A-Z0-9]{0,5}([.-][A-Z0-9]{1,2}){0,2}$`)
+
+func (u *Universe) Summary() string {
+	return fmt.Sprintf("Universe: %s as of %s - %d symbols - Duplicates: %d - Invalid: %d - Unknown: %d - Delisted: %d - Renamed: %d",
+		u.Name, u.AsOf, len(u.Symbols), len(u.Duplicates), len(u.Invalid), len(u.Unknown), len(u.Delisted), len(u.Renamed))
+}
+
+func (u *Universe) ToString() string {
+	str := u.Summary() + "\n"
+	str += fmt.Sprintf("File: %s\n", u.File)
+	str += fmt.Sprintf("Duplicates (%d): %s\n", len(u.Duplicates), strings.Join(u.Duplicates, ", "))
+	str += fmt.Sprintf("Invalid (%d): %s\n", len(u.Invalid), strings.Join(u.Invalid, ", "))
+	str += fmt.Sprintf("Unknown (%d): %s\n", len(u.Unknown), strings.Join(u.Unknown, ", "))
+	var delisted, renamed []string
+	for _, change := range u.Delisted {
+		delisted = append(delisted, fmt.Sprintf("%s on %s", change.Symbol, change.Date))
+	}
+	for _, change := range u.Renamed {
+		renamed = append(renamed, fmt.Sprintf("%s to %s on %s", change.Symbol, change.NewSymbol, change.Date))
+	}
+	str += fmt.Sprintf("Delisted (%d): %s\n", len(delisted), strings.Join(delisted, ", "))
+	str += fmt.Sprintf("Renamed (%d): %s\n", len(renamed), strings.Join(renamed, ", "))
+	return str
+}
+
+// reads the named universes, one "<name> <file>" per line. relative files are
+// resolved from the directory of the registry and lines starting with # are
+// ignored. a registry that does not exist has no universes, with a warning.
+func loadUniverseRegistry(filename string) (map[string]string, error) {
+	registry := make(map[string]string)
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		fmt.Printf("WARNING: %s not found, no named universes are available\n", filename)
+		return registry, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for lineNum, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<name> <file>\"", filename, lineNum+1)
+		}
+		path := fields[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(filename), path)
+		}
+		registry[fields[0]] = path
+	}
+	return registry, nil
+}
+
+// adds a universe to the registry. a name that is already taken by another
+// file has its line rewritten to the new file; the other lines are kept.
+func registerUniverse(filename, name, path string) error {
+	if _, err := os.Stat(filename); err == nil {
+		registry, err := loadUniverseRegistry(filename)
+		if err != nil {
+			return err
+		}
+		if registered, ok := registry[name]; ok {
+			if filepath.Clean(registered) == filepath.Clean(path) {
+				return nil
+			}
+			raw, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			lines := strings.Split(string(raw), "\n")
+			for i, line := range lines {
+				fields := strings.Fields(line)
+				if len(fields) > 0 && fields[0] == name {
+					fmt.Printf("Universe %s: replacing %s with %s\n", name, registered, path)
+					lines[i] = fmt.Sprintf("%s %s", name, path)
 				}
-			} else {
-				if data[j].Low < data[i].Low {
-					isPivot = false
+			}
+			return ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0644)
+		}
+	}
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %s\n", name, path)
+	return err
+}
+
+// returns the name and file of a universe: STOCK_FILE when no name is given,
+// then a named universe of the registry, then a symbol file
+func resolveUniverse(name string) (string, string, error) {
+	if name == "" {
+		return DEFAULT_UNIVERSE, STOCK_FILE, nil
+	}
+	registry, err := loadUniverseRegistry(*universesFile)
+	if err != nil {
+		return "", "", err
+	}
+	if path, ok := registry[name]; ok {
+		return name, path, nil
+	}
+	if _, err := os.Stat(name); err == nil {
+		return name, name, nil
+	}
+	return "", "", fmt.Errorf("unknown universe: %s", name)
+}
+
+// reads delistings and renames from a CSV file with symbol, event, date and
+// new_symbol columns. events are "delisted" or "renamed" and take effect on
+// their date. lines starting with # are ignored and a file that does not
+// exist has no changes, with a warning.
+func loadSymbolChanges(filename string) (map[string][]SymbolChange, error) {
+	changes := make(map[string][]SymbolChange)
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		fmt.Printf("WARNING: %s not found, no delistings or renames are applied\n", filename)
+		return changes, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(strings.NewReader(string(raw)))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(rows) == 0 {
+		return changes, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	for _, row := range rows[1:] {
+		change := SymbolChange{strings.ToUpper(field(row, "symbol")), strings.ToLower(field(row, "event")), field(row, "date"), strings.ToUpper(field(row, "new_symbol"))}
+		if change.Symbol == "" {
+			continue
+		}
+		if _, err := time.Parse(TIME_LAYOUT, change.Date); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", filename, change.Symbol, err)
+		}
+		if change.Event != SYMBOL_DELISTED && change.Event != SYMBOL_RENAMED {
+			return nil, fmt.Errorf("%s: %s: unknown event %q", filename, change.Symbol, change.Event)
+		}
+		if change.Event == SYMBOL_RENAMED && change.NewSymbol == "" {
+			return nil, fmt.Errorf("%s: %s: rename without a new symbol", filename, change.Symbol)
+		}
+		changes[change.Symbol] = append(changes[change.Symbol], change)
+	}
+	for symbol := range changes {
+		sort.SliceStable(changes[symbol], func(i, j int) bool {
+			return changes[symbol][i].Date < changes[symbol][j].Date
+		})
+	}
+	return changes, nil
+}
+
+// reads a symbol file, one symbol per line, and cleans it as of a date. a
+// symbol renamed by then is followed to its latest symbol; one delisted by
+// then, under any of its symbols, is removed. metadata may be nil, in which
+// case no symbol is unknown.
+func loadUniverse(name, filename, asOf string, changes map[string][]SymbolChange, metadata map[string]*SymbolMetadata) (*Universe, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	universe := &Universe{Name: name, File: filename, AsOf: asOf}
+
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(raw), "\n") {
+		symbol := strings.ToUpper(strings.TrimSpace(line))
+		if symbol == "" || strings.HasPrefix(symbol, "#") {
+			continue
+		}
+		if !symbolPattern.MatchString(symbol) {
+			universe.Invalid = append(universe.Invalid, symbol)
+			continue
+		}
+
+		current, delisted := symbol, false
+		followed := map[string]bool{symbol: true}
+	changes:
+		for {
+			for _, change := range changes[current] {
+				if change.Date > asOf {
 					break
 				}
+				if change.Event == SYMBOL_DELISTED {
+					universe.Delisted = append(universe.Delisted, change)
+					delisted = true
+					break changes
+				}
+				if !followed[change.NewSymbol] {
+					universe.Renamed = append(universe.Renamed, change)
+					followed[change.NewSymbol] = true
+					current = change.NewSymbol
+					continue changes
+				}
 			}
+			break
 		}
-		if isPivot {
-			pivots = append(pivots, i)
+		if delisted {
+			continue
+		}
+
+		if seen[current] {
+			universe.Duplicates = append(universe.Duplicates, symbol)
+			continue
+		}
+		seen[current] = true
+		universe.Symbols = append(universe.Symbols, current)
+		if metadata != nil {
+			if _, ok := metadata[current]; !ok {
+				universe.Unknown = append(universe.Unknown, current)
+			}
 		}
 	}
+	return universe, nil
+}
 
-	return pivots
+// loads and cleans a universe with the -universes, -symbol-changes,
+// -metadata and -as-of flags. missing symbol metadata only skips the check
+// for unknown symbols.
+func getUniverse(name string, t time.Time) (*Universe, error) {
+	asOf := t.Format(TIME_LAYOUT)
+	if *asOfDate != "" {
+		date, err := time.Parse(TIME_LAYOUT, *asOfDate)
+		if err != nil {
+			return nil, err
+		}
+		asOf = date.Format(TIME_LAYOUT)
+	}
+	name, filename, err := resolveUniverse(name)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := loadSymbolChanges(*symbolChangesFile)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := loadSymbolMetadata(*metadataFile)
+	if os.IsNotExist(err) {
+		metadata = nil
+	} else if err != nil {
+		return nil, err
+	}
+	return loadUniverse(name, filename, asOf, changes, metadata)
 }
 
-func getStockData(c chan interface{}, symbol, endMonth, endDay, endYear, startMonth, startDay, startYear string) {
-	url := fmt.Sprintf(YAHOO_FINANCE_API_URL, symbol, endMonth, endDay, endYear, startMonth, startDay, startYear)
-	resp, httpErr := http.Get(url)
-	if httpErr != nil {
-		go getStockData(c, symbol, endMonth, endDay, endYear, startMonth, startDay, startYear)
-		return
+func writeUniverse(filename string, symbols []string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	return ioutil.WriteFile(filename, []byte(strings.Join(symbols, "\n")+"\n"), 0644)
+}
 
-	reader := csv.NewReader(resp.Body)
-	rawCSVdata, csvErr := reader.ReadAll()
+// keeps the symbols whose cached daily bars pass the technical pre-filters
+// (without relative strength) and whose metadata matches the -sector,
+// -industry and -exchange flags. returns the symbols kept and the number
+// removed by each filter.
+func buildUniverse(symbols []string, metadata map[string]*SymbolMetadata) ([]string, map[string]int) {
+	filters := getTechnicalFilters(nil)
+	removed := make(map[string]int)
+	matches := func(filter, value string) bool {
+		return filter == "" || strings.EqualFold(filter, value)
+	}
 
-	if csvErr != nil {
-		c <- nil
-		return
+	var kept []string
+	for _, symbol := range symbols {
+		if *sectorFilter != "" || *industryFilter != "" || *exchangeFilter != "" {
+			meta, ok := metadata[symbol]
+			if !ok || !matches(*sectorFilter, meta.Sector) || !matches(*industryFilter, meta.Industry) || !matches(*exchangeFilter, meta.Exchange) {
+				removed[METADATA_FILTER]++
+				continue
+			}
+		}
+		stock, err := loadCachedStockData(symbol)
+		if err != nil {
+			removed[NO_CACHED_DATA]++
+			continue
+		}
+		if failed, ok := applyTechnicalFilters(&stock, filters); !ok {
+			removed[failed]++
+			continue
+		}
+		kept = append(kept, symbol)
 	}
+	return kept, removed
+}
 
-	// move raw CSV data to structs
-	var oneBar StockBar
-	var allBars []StockBar
+// runs a universe command:
+//
+//	universe list
+//	universe validate [universe]
+//	universe clean [universe] [file]
+//	universe build <name> [universe]
+//
+// build filters the symbols of a universe, or every cached symbol, over the
+// cached daily bars, writes the result to UNIVERSE_FILE and registers it
+// under the name.
+func runUniverseCommand(args []string, t time.Time) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: universe list|validate|clean|build")
+	}
+	source := ""
+	if len(args) > 1 {
+		source = args[1]
+	}
 
-	for _, row := range rawCSVdata[1:] {
-		oneBar.Date = row[0]
-		oneBar.Open, _ = strconv.ParseFloat(row[1], 64)
-		oneBar.High, _ = strconv.ParseFloat(row[2], 64)
-		oneBar.Low, _ = strconv.ParseFloat(row[3], 64)
-		oneBar.Close, _ = strconv.ParseFloat(row[4], 64)
-		oneBar.Volume, _ = strconv.Atoi(row[5])
-		oneBar.AdjClose, _ = strconv.ParseFloat(row[6], 64)
-		allBars = append([]StockBar{oneBar}, allBars...)
+	switch args[0] {
+	case "list":
+		registry, err := loadUniverseRegistry(*universesFile)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for name := range registry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Printf("%s - %s\n", DEFAULT_UNIVERSE, STOCK_FILE)
+		for _, name := range names {
+			fmt.Printf("%s - %s\n", name, registry[name])
+		}
+		return nil
+	case "validate", "clean":
+		universe, err := getUniverse(source, t)
+		if err != nil {
+			return err
+		}
+		if args[0] == "validate" {
+			fmt.Print(universe.ToString())
+			return nil
+		}
+		filename := fmt.Sprintf(OUTPUT_UNIVERSE_FILE, t.Format("01-02-2006"))
+		if len(args) > 2 {
+			filename = args[2]
+		}
+		fmt.Println(universe.Summary())
+		return writeUniverse(filename, universe.Symbols)
+	case "build":
+		if source == "" {
+			return fmt.Errorf("usage: universe build <name> [universe]")
+		}
+		if *cacheDir == "" {
+			return fmt.Errorf("universe build reads cached data, see -cache")
+		}
+		var symbols []string
+		if len(args) > 2 {
+			universe, err := getUniverse(args[2], t)
+			if err != nil {
+				return err
+			}
+			symbols = universe.Symbols
+		} else {
+			files, err := filepath.Glob(filepath.Join(*cacheDir, "*.csv"))
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				symbols = append(symbols, strings.TrimSuffix(filepath.Base(file), ".csv"))
+			}
+		}
+		metadata, err := loadSymbolMetadata(*metadataFile)
+		if err != nil && (*sectorFilter != "" || *industryFilter != "" || *exchangeFilter != "") {
+			return err
+		}
+
+		kept, removed := buildUniverse(symbols, metadata)
+		fmt.Printf("Universe %s: kept %d of %d symbols\n", source, len(kept), len(symbols))
+		for _, name := range []string{METADATA_FILTER, NO_CACHED_DATA} {
+			fmt.Printf("%s: removed %d symbols\n", name, removed[name])
+		}
+		for _, filter := range getTechnicalFilters(nil) {
+			fmt.Printf("%s: removed %d symbols\n", filter.Name, removed[filter.Name])
+		}
+		filename := fmt.Sprintf(UNIVERSE_FILE, source)
+		if err := writeUniverse(filename, kept); err != nil {
+			return err
+		}
+		return registerUniverse(*universesFile, source, filename)
 	}
+	return fmt.Errorf("unknown universe command: %s", args[0])
+}
 
-	var data StockData
-	data.Data = allBars
-	data.Symbol = symbol
+// Membership is when a symbol was part of the universe: from its listed date
+// up to, but not including, its delisted date. either date may be empty when
+// the symbol was listed before any history or is still listed.
+type Membership struct {
+	Symbol   string
+	Listed   string
+	Delisted string
+}
 
-	c <- data
+func (m *Membership) Contains(date string) bool {
+	return date >= m.Listed && (m.Delisted == "" || date < m.Delisted)
+}
+
+// reads point-in-time universe membership from a CSV file with symbol, listed
+// and delisted columns, one row per symbol. lines starting with # are ignored.
+func loadMembership(filename string) (map[string]*Membership, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(strings.NewReader(string(raw)))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: no header row", filename)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["symbol"]; !ok {
+		return nil, fmt.Errorf("%s: no symbol column", filename)
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	membership := make(map[string]*Membership)
+	for _, row := range rows[1:] {
+		member := &Membership{strings.ToUpper(field(row, "symbol")), field(row, "listed"), field(row, "delisted")}
+		if member.Symbol == "" {
+			continue
+		}
+		if _, ok := membership[member.Symbol]; ok {
+			return nil, fmt.Errorf("%s: %s is listed twice", filename, member.Symbol)
+		}
+		for _, date := range []string{member.Listed, member.Delisted} {
+			if date == "" {
+				continue
+			}
+			if _, err := time.Parse(TIME_LAYOUT, date); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", filename, member.Symbol, err)
+			}
+		}
+		if member.Delisted != "" && member.Delisted <= member.Listed {
+			return nil, fmt.Errorf("%s: %s is delisted before it is listed", filename, member.Symbol)
+		}
+		membership[member.Symbol] = member
+	}
+	return membership, nil
+}
+
+func getMembershipSymbols(membership map[string]*Membership) []string {
+	var symbols []string
+	for symbol := range membership {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// reports whether the stock has bars to replay while the symbol was a member
+func hasMemberBars(stock *StockData, member *Membership) bool {
+	for t := STUDY_MIN_BARS; t < len(stock.Data); t++ {
+		if member.Contains(stock.Data[t].Date) {
+			return true
+		}
+	}
+	return false
+}
+
+// summarizes the membership of a study. members without bars to replay are
+// listed, since missing delisted members bias the study toward survivors.
+func getMembershipSummary(membership map[string]*Membership, studied map[string]bool, events []StudyEvent) string {
+	delisted := 0
+	var missing, missingDelisted []string
+	for _, symbol := range getMembershipSymbols(membership) {
+		member := membership[symbol]
+		if member.Delisted != "" {
+			delisted++
+		}
+		if studied[symbol] {
+			continue
+		}
+		missing = append(missing, symbol)
+		if member.Delisted != "" {
+			missingDelisted = append(missingDelisted, symbol)
+		}
+	}
+	closed := 0
+	for _, event := range events {
+		if event.Delisted {
+			closed++
+		}
+	}
+
+	str := fmt.Sprintf("Membership: %d symbols, %d delisted - %d setups measured at a delisting\n", len(membership), delisted, closed)
+	str += fmt.Sprintf("Members without bars: %d (%d delisted)", len(missing), len(missingDelisted))
+	if len(missing) > 0 {
+		str += " - " + strings.Join(missing, ", ")
+	}
+	str += "\n"
+	if len(missingDelisted) > 0 {
+		str += fmt.Sprintf("WARNING: %d of %d delisted members have no cached bars, the study is biased toward survivors: %s\n",
+			len(missingDelisted), delisted, strings.Join(missingDelisted, ", "))
+	}
+	return str
 }
@@ -7,6 +7,27 @@
 // program will then output the results of the backtest if we were to
 // implement the strategy between the two dates.
 // USAGE: go run swing_trade_etf_backtest.go 01-01-2000 01-01-2005
+//        go run swing_trade_etf_backtest.go -regime=gate 01-01-2004 01-01-2014
+//        go run swing_trade_etf_backtest.go -atr-timeframe=weekly 01-01-2004 01-01-2014
+//        go run swing_trade_etf_backtest.go -interval=5m 2024-01-02 2024-03-29
+
+// Market Regime:
+// The -regime flag reads the IBD market direction series in IBD_data.txt.
+// "stats" only splits the results by regime, "gate" holds longs only while
+// the market is not in a downtrend and shorts only while it is, and "scale"
+// sizes exposure continuously from the series value.
+
+// Higher-Timeframe ATR:
+// The -atr-timeframe flag sizes the ladder on the ATR of weekly or monthly
+// bars instead of daily ones. each day uses the ATR of the last completed
+// period so the current period's range is never looked ahead at.
+
+// Intraday Bars:
+// The -interval flag runs the ladder on 5 or 15 minute (or any whole minute)
+// bars read from the local CSV given by -intraday-data instead of daily bars,
+// with the ATR measured in bars of that interval. -hours picks regular or
+// extended trading hours and -atr-timeframe=daily sizes the ladder on the
+// daily ATR instead.
 
 // Key Assumptions:
 // - TQQQ and SQQQ reflect exactly 3x the daily percentage change in QQQ
@@ -16,12 +37,15 @@ package main
 
 import (
 	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"fmt"
-	// "io/ioutil"
+	"io/ioutil"
 	"math"
 	"net/http"
-	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -43,6 +67,21 @@ const (
 	ATR_MULT_EXIT_POSITION   float64 = 1.5
 	ATR_MULT_CHANGE_POSITION float64 = 2.0
 	ATR_MULT_ADD_POSITION    float64 = 2.5
+	HIGHER_TIMEFRAME_WINDOW  int     = 14
+	DAILY                    string  = "daily"
+	WEEKLY                   string  = "weekly"
+	MONTHLY                  string  = "monthly"
+
+	// Intraday Configuration
+	INTRADAY_DATA_FILE    string = "/Users/albert/Desktop/stocks/intraday/%s.csv"
+	INTRADAY_TIME_LAYOUT  string = "2006-01-02 15:04"
+	EXCHANGE_TIMEZONE     string = "America/New_York"
+	REGULAR_HOURS         string = "regular"
+	EXTENDED_HOURS        string = "extended"
+	REGULAR_OPEN_MINUTE   int    = 9*60 + 30
+	REGULAR_CLOSE_MINUTE  int    = 16 * 60
+	EXTENDED_OPEN_MINUTE  int    = 4 * 60
+	EXTENDED_CLOSE_MINUTE int    = 20 * 60
 
 	// Portfolio Configuration
 	INITIAL_CAPITAL          float64 = 100000.0
@@ -51,6 +90,29 @@ const (
 	LONG_MAX_PERCENTAGE      float64 = 1
 	SHORT_PARTIAL_PERCENTAGE float64 = 0.5
 	SHORT_MAX_PERCENTAGE     float64 = 1
+
+	// Market Regime Configuration
+	IBD_DATA_FILE         string = "/Users/albert/Desktop/stocks/IBD_data.txt"
+	REGIME_OFF            string = "off"
+	REGIME_STATS          string = "stats"
+	REGIME_GATE           string = "gate"
+	REGIME_SCALE          string = "scale"
+	UPTREND               string = "Uptrend"
+	MIXED                 string = "Mixed"
+	DOWNTREND             string = "Downtrend"
+	UNKNOWN_REGIME        string = "Unknown"
+	REGIME_MAX_STALE_DAYS int    = 7
+)
+
+var (
+	regimeMode = flag.String("regime", REGIME_OFF, "market regime usage: off, stats, gate or scale")
+	regimeFile = flag.String("regime-file", IBD_DATA_FILE, "path to the IBD market direction series")
+
+	atrTimeframe = flag.String("atr-timeframe", "", "bars the ladder's ATR is measured on: daily, weekly or monthly (default: the simulated bars)")
+
+	barInterval   = flag.String("interval", DAILY, "bars to simulate on: daily or an intraday interval such as 5m or 15m")
+	intradayFile  = flag.String("intraday-data", INTRADAY_DATA_FILE, "intraday CSV (timestamp,open,high,low,close,volume), %s is the symbol")
+	intradayHours = flag.String("hours", REGULAR_HOURS, "intraday bars to keep: regular (09:30-16:00) or extended (04:00-20:00) hours")
 )
 
 type Portfolio struct {
@@ -62,20 +124,26 @@ type Portfolio struct {
 	CurrentPosition interface{}
 	ClosedPositions []Position
 	Transactions    []Transaction
+	Regime          *MarketRegime
+	RegimeMode      string
+	ExposureScale   float64
+	ExposureRegime  string
+	ExposedPosition *Position
+	RegimeStats     map[string]*RegimeStats
 }
 
-// enters an initial position
-func (p *Portfolio) EnterInitialPosition(data *StockData) {
+// enters an initial position at the bar starting at startDate, the first bar
+// of the simulation
+func (p *Portfolio) EnterInitialPosition(data *StockData, startDate time.Time) {
 	currExtreme := Extreme{}
 	initialPrice := data.Data[0].Close
 	initialATR := data.Data[0].ATR
-	startDate, _ := time.Parse(TIME_LAYOUT, p.StartDate)
 	var startDateIndex int
 	var offset int
 
 	// find an extreme value (local min or max) before the start date of the portfolio
 	for i, bar := range data.Data {
-		currBarDate, _ := time.Parse(TIME_LAYOUT, bar.Date)
+		currBarDate := bar.Time
 		if currBarDate.Before(startDate) || currBarDate.Equal(startDate) {
 			// TODO: it is possible that an extreme is never chosen if ATR range is too wide
 			// get initial extreme
@@ -145,10 +213,14 @@ func (p *Portfolio) EnterInitialPosition(data *StockData) {
 // updates the portfolio's current position with the current day's data
 // since we're simulating only EOD trades if closing prices exceed ATR multiples,
 // we take the current closing price no matter what it is
+// when a market regime is in use, the position was sized by the exposure that
+// was set at the previous close
 func (p *Portfolio) UpdatePortfolio(currentDate time.Time, currClose float64) {
 	if p.CurrentPosition != nil {
 		currPosition := p.CurrentPosition.(*Position)
+		prevValue := p.CurrentValue
 		p.CurrentValue += currPosition.Update(currentDate, currClose)
+		p.RecordRegimeReturn(prevValue)
 	}
 	// TODO: add logging
 	// date, short or long, percentage gain, new value
@@ -227,6 +299,68 @@ func (p *Portfolio) AdjustPosition(currentDate time.Time, currClose, currATR flo
 	}
 }
 
+// sets the exposure used for the next bar from the market regime on the
+// given date. positions against the regime are cut to zero in gate mode and
+// sized by the regime value in scale mode. whenever the exposure or the
+// position changes, the position is resized to its allocation of the
+// portfolio times the exposure.
+func (p *Portfolio) UpdateExposure(currentDate time.Time) {
+	prevScale := p.ExposureScale
+	p.setExposure(currentDate)
+	if p.CurrentPosition == nil {
+		return
+	}
+	position := p.CurrentPosition.(*Position)
+	if p.ExposureScale != prevScale || position != p.ExposedPosition {
+		position.CurrentValue = p.CurrentValue * position.InitialPercentage * p.ExposureScale
+		p.ExposedPosition = position
+	}
+}
+
+func (p *Portfolio) setExposure(currentDate time.Time) {
+	p.ExposureScale = 1.0
+	p.ExposureRegime = UNKNOWN_REGIME
+	if p.Regime == nil {
+		return
+	}
+
+	day, ok := p.Regime.GetRegime(currentDate)
+	if !ok {
+		return
+	}
+	p.ExposureRegime = getRegimeLabel(day.Value)
+
+	if p.CurrentPosition == nil {
+		return
+	}
+	positionType := p.CurrentPosition.(*Position).Type
+	if p.RegimeMode == REGIME_GATE {
+		if (positionType == LONG_TYPE && day.Value < 0) || (positionType == SHORT_TYPE && day.Value > 0) {
+			p.ExposureScale = 0
+		}
+	} else if p.RegimeMode == REGIME_SCALE {
+		if positionType == LONG_TYPE {
+			p.ExposureScale = (1 + day.Value) / 2
+		} else {
+			p.ExposureScale = (1 - day.Value) / 2
+		}
+	}
+}
+
+// records the portfolio return of the current bar under the regime that set
+// the exposure for it
+func (p *Portfolio) RecordRegimeReturn(prevValue float64) {
+	if p.RegimeStats == nil || prevValue == 0 {
+		return
+	}
+	stats, ok := p.RegimeStats[p.ExposureRegime]
+	if !ok {
+		stats = &RegimeStats{Regime: p.ExposureRegime, Growth: 1.0}
+		p.RegimeStats[p.ExposureRegime] = stats
+	}
+	stats.Add(p.CurrentValue/prevValue - 1)
+}
+
 func (p *Portfolio) PositionChanged(positionType string, percentage float64) bool {
 	return !(p.CurrentPosition.(*Position).Type == positionType && p.CurrentPosition.(*Position).InitialPercentage == percentage)
 }
@@ -380,7 +514,7 @@ func (p *Position) Update(currDate time.Time, currClose float64) float64 {
 
 func (p *Position) ToString() string {
 	return fmt.Sprintf("%s %s - %.1fx Leverage - Entry Price and Date: $%.2f (%s) - Current Price and Date: $%.2f (%s) - Initial Investment: $%.2f - Current Value: $%.2f",
-		p.Type, p.Symbol, p.LeverageMultiple, p.EntryPrice, p.EntryDate.Format(TIME_LAYOUT), p.CurrentPrice, p.CurrentDate.Format(TIME_LAYOUT), p.InitialInvestment, p.CurrentValue)
+		p.Type, p.Symbol, p.LeverageMultiple, p.EntryPrice, p.EntryDate.Format(getTimeLayout()), p.CurrentPrice, p.CurrentDate.Format(getTimeLayout()), p.InitialInvestment, p.CurrentValue)
 }
 
 type Extreme struct {
@@ -399,6 +533,102 @@ func (e *Extreme) getATRThreshold(multiple float64) float64 {
 	}
 }
 
+type RegimeStats struct {
+	Regime   string
+	Days     int
+	UpDays   int
+	DownDays int
+	Growth   float64
+	SumDaily float64
+}
+
+func (s *RegimeStats) Add(dailyReturn float64) {
+	s.Days++
+	if dailyReturn > 0 {
+		s.UpDays++
+	} else if dailyReturn < 0 {
+		s.DownDays++
+	}
+	s.Growth *= 1 + dailyReturn
+	s.SumDaily += dailyReturn
+}
+
+func (s *RegimeStats) ToString() string {
+	if s.Days == 0 {
+		return fmt.Sprintf("%s - Days: 0", s.Regime)
+	}
+	return fmt.Sprintf("%s - Days: %d - Return: %.2f%% - Avg Daily Return: %.3f%% - Up Days: %d - Down Days: %d - Win Rate: %.1f%%",
+		s.Regime, s.Days, (s.Growth-1)*100, s.SumDaily/float64(s.Days)*100, s.UpDays, s.DownDays, float64(s.UpDays)/float64(s.Days)*100)
+}
+
+type MarketRegime struct {
+	Days []RegimeDay
+}
+
+type RegimeDay struct {
+	Date  time.Time
+	Value float64
+}
+
+// returns the latest regime reading on or before the given date. readings more
+// than REGIME_MAX_STALE_DAYS old are not used.
+func (r *MarketRegime) GetRegime(date time.Time) (RegimeDay, bool) {
+	i := sort.Search(len(r.Days), func(i int) bool {
+		return r.Days[i].Date.After(date)
+	})
+	if i == 0 {
+		return RegimeDay{}, false
+	}
+	day := r.Days[i-1]
+	if date.Sub(day.Date) > time.Duration(REGIME_MAX_STALE_DAYS)*24*time.Hour {
+		return RegimeDay{}, false
+	}
+	return day, true
+}
+
+func getRegimeLabel(value float64) string {
+	if value >= 1 {
+		return UPTREND
+	} else if value < 0 {
+		return DOWNTREND
+	}
+	return MIXED
+}
+
+// parses the IBD market direction series, which is stored as a javascript
+// array literal: var cbti_array = [[unix_ts, value], ...];
+func loadMarketRegime(filename string) (*MarketRegime, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	text := string(raw)
+	start := strings.Index(text, "[")
+	end := strings.LastIndex(text, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%s: no regime array found", filename)
+	}
+
+	var points [][]float64
+	if err := json.Unmarshal([]byte(text[start:end+1]), &points); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	regime := MarketRegime{}
+	for _, point := range points {
+		if len(point) != 2 {
+			return nil, fmt.Errorf("%s: malformed regime entry %v", filename, point)
+		}
+		regime.Days = append(regime.Days, RegimeDay{time.Unix(int64(point[0]), 0).UTC(), point[1]})
+	}
+	sort.Slice(regime.Days, func(i, j int) bool {
+		return regime.Days[i].Date.Before(regime.Days[j].Date)
+	})
+
+	return &regime, nil
+}
+
 type Transaction struct {
 	Date string
 }
@@ -410,6 +640,7 @@ type StockData struct {
 
 type StockBar struct {
 	Date     string
+	Time     time.Time
 	Open     float64
 	High     float64
 	Low      float64
@@ -424,29 +655,101 @@ func (b *StockBar) ToString() string {
 }
 
 func main() {
-	args := os.Args[1:]
+	flag.Parse()
+	args := flag.Args()
 	if len(args) != 2 {
 		panic("Not enough arguments.")
 	}
-	portfolio := Portfolio{args[0], args[1], args[0], INITIAL_CAPITAL, INITIAL_CAPITAL, nil, make([]Position, 0), make([]Transaction, 0)}
-	ETFData := getStockData(ETF, NUM_YEARS_DATA)
+	portfolio := Portfolio{
+		StartDate:       args[0],
+		EndDate:         args[1],
+		CurrentDate:     args[0],
+		InitialValue:    INITIAL_CAPITAL,
+		CurrentValue:    INITIAL_CAPITAL,
+		ClosedPositions: make([]Position, 0),
+		Transactions:    make([]Transaction, 0),
+		RegimeMode:      *regimeMode,
+		ExposureScale:   1.0,
+		ExposureRegime:  UNKNOWN_REGIME,
+	}
+
+	switch *regimeMode {
+	case REGIME_OFF:
+	case REGIME_STATS, REGIME_GATE, REGIME_SCALE:
+		regime, err := loadMarketRegime(*regimeFile)
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: Unable to load market regime: %v", err))
+		}
+		portfolio.Regime = regime
+		portfolio.RegimeStats = make(map[string]*RegimeStats)
+	default:
+		panic(fmt.Sprintf("Unknown regime mode: %s", *regimeMode))
+	}
+
+	var ETFData StockData
+	interval, intraday := getIntradayInterval(*barInterval)
+	if intraday {
+		data, err := loadIntradayData(fmt.Sprintf(*intradayFile, ETF), ETF, interval)
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: Unable to load intraday data: %v", err))
+		}
+		ETFData = data
+	} else if *barInterval == DAILY {
+		ETFData = getStockData(ETF, NUM_YEARS_DATA)
+	} else {
+		panic(fmt.Sprintf("Unknown interval: %s", *barInterval))
+	}
+
+	switch *atrTimeframe {
+	case "":
+	case DAILY:
+		if intraday {
+			setHigherTimeframeATR(&ETFData, DAILY, HIGHER_TIMEFRAME_WINDOW)
+		}
+	case WEEKLY, MONTHLY:
+		setHigherTimeframeATR(&ETFData, *atrTimeframe, HIGHER_TIMEFRAME_WINDOW)
+	default:
+		panic(fmt.Sprintf("Unknown ATR timeframe: %s", *atrTimeframe))
+	}
 	simulate(&portfolio, &ETFData)
 	fmt.Println(portfolio.ToString())
+
+	if portfolio.RegimeStats != nil {
+		fmt.Println("=============== Market Regime ===============")
+		for _, label := range []string{UPTREND, MIXED, DOWNTREND, UNKNOWN_REGIME} {
+			if stats, ok := portfolio.RegimeStats[label]; ok {
+				fmt.Println(stats.ToString())
+			}
+		}
+	}
 }
 
 func simulate(portfolio *Portfolio, etfData *StockData) {
 	startDate, _ := time.Parse(TIME_LAYOUT, portfolio.StartDate)
 	endDate, _ := time.Parse(TIME_LAYOUT, portfolio.EndDate)
+	// the regime reading for a day is only known after its close, so intraday
+	// bars use the reading of the previous session
+	_, intraday := getIntradayInterval(*barInterval)
+	var sessionDate, prevSessionDate time.Time
 	for _, bar := range etfData.Data {
-		currBarDate, _ := time.Parse(TIME_LAYOUT, bar.Date)
+		// intraday bars are simulated on every bar of the start and end dates
+		currBarDate, _ := time.Parse(TIME_LAYOUT, bar.Time.Format(TIME_LAYOUT))
+		if !currBarDate.Equal(sessionDate) {
+			prevSessionDate, sessionDate = sessionDate, currBarDate
+		}
+		regimeDate := bar.Time
+		if intraday {
+			regimeDate = prevSessionDate
+		}
 		if (currBarDate.After(startDate) || currBarDate.Equal(startDate)) && (currBarDate.Before(endDate) || currBarDate.Equal(endDate)) {
 			// create initial position
 			if portfolio.CurrentPosition == nil {
-				portfolio.EnterInitialPosition(etfData)
+				portfolio.EnterInitialPosition(etfData, bar.Time)
 			} else {
-				portfolio.UpdatePortfolio(currBarDate, bar.Close)
-				portfolio.AdjustPosition(currBarDate, bar.Close, bar.ATR)
+				portfolio.UpdatePortfolio(bar.Time, bar.Close)
+				portfolio.AdjustPosition(bar.Time, bar.Close, bar.ATR)
 			}
+			portfolio.UpdateExposure(regimeDate)
 		}
 	}
 }
@@ -480,6 +783,7 @@ func getStockDataHelper(symbol, endMonth, endDay, endYear, startMonth, startDay,
 
 	for _, row := range rawCSVdata[1:] {
 		oneBar.Date = row[0]
+		oneBar.Time, _ = time.Parse(TIME_LAYOUT, row[0])
 		oneBar.Open, _ = strconv.ParseFloat(row[1], 64)
 		oneBar.High, _ = strconv.ParseFloat(row[2], 64)
 		oneBar.Low, _ = strconv.ParseFloat(row[3], 64)
@@ -492,7 +796,7 @@ func getStockDataHelper(symbol, endMonth, endDay, endYear, startMonth, startDay,
 	// compute ATR
 	var tempATRList []float64
 	for i := 1; i < len(allBars); i++ {
-		allBars[i].ATR = getUpdatedATR(&tempATRList, getTradingRange(allBars[i-1], allBars[i]))
+		allBars[i].ATR = getUpdatedATR(&tempATRList, getTradingRange(allBars[i-1], allBars[i]), ATR_WINDOW)
 	}
 
 	return StockData{allBars, symbol}
@@ -515,8 +819,8 @@ func getTradingRange(prevBar, currBar StockBar) float64 {
 	return max
 }
 
-func getUpdatedATR(list *[]float64, newValue float64) float64 {
-	if len(*list) < ATR_WINDOW {
+func getUpdatedATR(list *[]float64, newValue float64, window int) float64 {
+	if len(*list) < window {
 		*list = append(*list, newValue)
 		return -1.0
 	} else {
@@ -525,6 +829,189 @@ func getUpdatedATR(list *[]float64, newValue float64) float64 {
 		for _, val := range *list {
 			sum += val
 		}
-		return sum / float64(ATR_WINDOW)
+		return sum / float64(window)
+	}
+}
+
+// replaces each bar's ATR with the ATR of the daily, weekly or monthly bars
+// completed before it. periods are aggregated from the bars: first open, last
+// close and the extreme high and low.
+func setHigherTimeframeATR(data *StockData, timeframe string, window int) {
+	var tempATRList []float64
+	var prevPeriod, period StockBar
+	periodKey, numPeriods := -1, 0
+	periodATR := -1.0
+	for i := range data.Data {
+		bar := &data.Data[i]
+		key := getPeriodKey(bar.Time, timeframe)
+		if key != periodKey {
+			if numPeriods > 0 {
+				// the previous period is complete
+				if numPeriods > 1 {
+					periodATR = getUpdatedATR(&tempATRList, getTradingRange(prevPeriod, period), window)
+				}
+				prevPeriod = period
+			}
+			period = *bar
+			periodKey = key
+			numPeriods++
+		} else {
+			period.High = math.Max(period.High, bar.High)
+			period.Low = math.Min(period.Low, bar.Low)
+			period.Close = bar.Close
+		}
+		bar.ATR = periodATR
+	}
+}
+
+// identifies the day, ISO week or month a date falls in
+func getPeriodKey(date time.Time, timeframe string) int {
+	switch timeframe {
+	case DAILY:
+		return date.Year()*10000 + int(date.Month())*100 + date.Day()
+	case MONTHLY:
+		return date.Year()*100 + int(date.Month())
+	}
+	year, week := date.ISOWeek()
+	return year*100 + week
+}
+
+// reads intraday bars from a local CSV file with a header row and timestamp,
+// open, high, low, close and volume columns and aggregates them into bars of
+// the interval, counted from the open of the trading hours. timestamps are
+// unix seconds or dates with a time of day, in exchange time unless they carry
+// an offset. bars outside the -hours trading hours are dropped.
+func loadIntradayData(filename, symbol string, interval time.Duration) (StockData, error) {
+	data := StockData{Symbol: symbol}
+	location, err := time.LoadLocation(EXCHANGE_TIMEZONE)
+	if err != nil {
+		return data, err
+	}
+	openMinute, closeMinute := REGULAR_OPEN_MINUTE, REGULAR_CLOSE_MINUTE
+	switch *intradayHours {
+	case REGULAR_HOURS:
+	case EXTENDED_HOURS:
+		openMinute, closeMinute = EXTENDED_OPEN_MINUTE, EXTENDED_CLOSE_MINUTE
+	default:
+		return data, fmt.Errorf("unknown trading hours: %s", *intradayHours)
+	}
+
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return data, err
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(raw))).ReadAll()
+	if err != nil {
+		return data, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	var bars []StockBar
+	for i, row := range rows {
+		if i == 0 {
+			continue
+		}
+		if len(row) < 6 {
+			return data, fmt.Errorf("%s:%d: expected 6 columns, got %d", filename, i+1, len(row))
+		}
+		timestamp, err := parseTimestamp(row[0], location)
+		if err != nil {
+			return data, fmt.Errorf("%s:%d: %v", filename, i+1, err)
+		}
+		minute := timestamp.Hour()*60 + timestamp.Minute()
+		if timestamp.Weekday() == time.Saturday || timestamp.Weekday() == time.Sunday || minute < openMinute || minute >= closeMinute {
+			continue
+		}
+		var bar StockBar
+		bar.Time = timestamp
+		bar.Open, _ = strconv.ParseFloat(row[1], 64)
+		bar.High, _ = strconv.ParseFloat(row[2], 64)
+		bar.Low, _ = strconv.ParseFloat(row[3], 64)
+		bar.Close, _ = strconv.ParseFloat(row[4], 64)
+		bar.Volume, _ = strconv.Atoi(row[5])
+		bar.AdjClose = bar.Close
+		bars = append(bars, bar)
+	}
+	if len(bars) == 0 {
+		return data, fmt.Errorf("%s: no bars within trading hours", filename)
+	}
+	sort.Slice(bars, func(i, j int) bool {
+		return bars[i].Time.Before(bars[j].Time)
+	})
+
+	// the file's bars are aggregated into bars of the interval, so the
+	// interval has to be a multiple of their spacing
+	var spacing time.Duration
+	for i := 1; i < len(bars); i++ {
+		gap := bars[i].Time.Sub(bars[i-1].Time)
+		if gap > 0 && getPeriodKey(bars[i].Time, DAILY) == getPeriodKey(bars[i-1].Time, DAILY) && (spacing == 0 || gap < spacing) {
+			spacing = gap
+		}
+	}
+	if spacing > 0 && interval%spacing != 0 {
+		return data, fmt.Errorf("%s: %s bars cannot be built from %s bars", filename, interval, spacing)
+	}
+	step := int(interval / time.Minute)
+	periodKey := func(t time.Time) int {
+		return getPeriodKey(t, DAILY)*10000 + (t.Hour()*60+t.Minute()-openMinute)/step
+	}
+	for _, bar := range bars {
+		if len(data.Data) > 0 && periodKey(bar.Time) == periodKey(data.Data[len(data.Data)-1].Time) {
+			last := &data.Data[len(data.Data)-1]
+			last.High = math.Max(last.High, bar.High)
+			last.Low = math.Min(last.Low, bar.Low)
+			last.Close = bar.Close
+			last.AdjClose = bar.AdjClose
+			last.Volume += bar.Volume
+			continue
+		}
+		data.Data = append(data.Data, bar)
+	}
+
+	// bars are dated by the start of their period
+	var tempATRList []float64
+	for i := range data.Data {
+		bar := &data.Data[i]
+		minute := openMinute + (bar.Time.Hour()*60+bar.Time.Minute()-openMinute)/step*step
+		bar.Time = time.Date(bar.Time.Year(), bar.Time.Month(), bar.Time.Day(), minute/60, minute%60, 0, 0, location)
+		bar.Date = bar.Time.Format(INTRADAY_TIME_LAYOUT)
+		if i > 0 {
+			bar.ATR = getUpdatedATR(&tempATRList, getTradingRange(data.Data[i-1], *bar), ATR_WINDOW)
+		}
+	}
+
+	return data, nil
+}
+
+// parses an intraday timestamp: unix seconds, RFC 3339 or a date and time of
+// day in the given location
+func parseTimestamp(value string, location *time.Location) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).In(location), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(location), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", INTRADAY_TIME_LAYOUT, "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", value)
+}
+
+// returns the bar interval of an intraday interval such as 5m or 15m
+func getIntradayInterval(interval string) (time.Duration, bool) {
+	duration, err := time.ParseDuration(interval)
+	if err != nil || duration < time.Minute || duration%time.Minute != 0 || duration >= 24*time.Hour {
+		return 0, false
+	}
+	return duration, true
+}
+
+// returns the layout dates of the simulated bars are formatted with
+func getTimeLayout() string {
+	if *barInterval != DAILY {
+		return INTRADAY_TIME_LAYOUT
 	}
+	return TIME_LAYOUT
 }